@@ -0,0 +1,349 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	RulesFlag = "rules"
+)
+
+// Alert rule types.
+const (
+	ruleNoNewBlock     = "no_new_block"
+	ruleTransferAbove  = "transfer_above"
+	ruleBaseFeeAbove   = "base_fee_above"
+	ruleReorgDeeper    = "reorg_depth_above"
+	ruleGasUtilization = "gas_utilization_above"
+)
+
+// Alert severities, from lowest to highest.
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// alertRulesFile is the YAML rules file of --rules, for example:
+//
+//	webhook: https://alerts.example.com/hook
+//	rules:
+//	  - name: chain stalled
+//	    type: no_new_block
+//	    severity: critical
+//	    seconds: 30
+//	  - name: large USDC transfer
+//	    type: transfer_above
+//	    token: USDC
+//	    amount: "1000000"
+//	  - name: base fee spike
+//	    type: base_fee_above
+//	    gwei: 100
+//	  - name: deep reorg
+//	    type: reorg_depth_above
+//	    depth: 2
+//	  - name: blocks full
+//	    type: gas_utilization_above
+//	    percent: 95
+//	    blocks: 10
+type alertRulesFile struct {
+	Webhook string      `yaml:"webhook"`
+	Rules   []alertRule `yaml:"rules"`
+}
+
+// alertRule is one rule of the rules file. Which fields apply depends on
+// the type.
+type alertRule struct {
+	Name     string  `yaml:"name"`
+	Type     string  `yaml:"type"`
+	Severity string  `yaml:"severity"`
+	Seconds  float64 `yaml:"seconds"` // no_new_block
+	Token    string  `yaml:"token"`   // transfer_above: symbol or address, empty for any
+	Amount   string  `yaml:"amount"`  // transfer_above, in token units
+	Gwei     float64 `yaml:"gwei"`    // base_fee_above
+	Depth    uint64  `yaml:"depth"`   // reorg_depth_above
+	Percent  float64 `yaml:"percent"` // gas_utilization_above
+	Blocks   int     `yaml:"blocks"`  // gas_utilization_above
+
+	amount  *big.Rat
+	baseFee *big.Int // wei
+
+	// Rules on a condition, rather than on single events, fire once when
+	// it starts to hold and resolve when it stops.
+	firing bool
+	streak int
+}
+
+func loadAlertRules(path string) (*alertRulesFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f alertRulesFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(f.Rules) == 0 {
+		return nil, fmt.Errorf("%s: no rules", path)
+	}
+	for i := range f.Rules {
+		if err := f.Rules[i].validate(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+	}
+	return &f, nil
+}
+
+func (r *alertRule) validate() error {
+	if r.Name == "" {
+		r.Name = r.Type
+	}
+	switch r.Severity {
+	case "":
+		r.Severity = severityWarning
+	case severityInfo, severityWarning, severityCritical:
+	default:
+		return fmt.Errorf("unknown severity %q: want info, warning or critical", r.Severity)
+	}
+	switch r.Type {
+	case ruleNoNewBlock:
+		if r.Seconds <= 0 {
+			return fmt.Errorf("%s needs seconds > 0", r.Type)
+		}
+	case ruleTransferAbove:
+		amount, ok := new(big.Rat).SetString(r.Amount)
+		if !ok || amount.Sign() < 0 {
+			return fmt.Errorf("%s needs an amount in token units, got %q", r.Type, r.Amount)
+		}
+		r.amount = amount
+	case ruleBaseFeeAbove:
+		if r.Gwei <= 0 {
+			return fmt.Errorf("%s needs gwei > 0", r.Type)
+		}
+		r.baseFee, _ = new(big.Float).Mul(big.NewFloat(r.Gwei), big.NewFloat(params.GWei)).Int(nil)
+	case ruleReorgDeeper:
+	case ruleGasUtilization:
+		if r.Percent <= 0 {
+			return fmt.Errorf("%s needs percent > 0", r.Type)
+		}
+		if r.Blocks <= 0 {
+			r.Blocks = 1
+		}
+	default:
+		return fmt.Errorf("unknown rule type %q", r.Type)
+	}
+	return nil
+}
+
+// records returns the kind of record the rule is evaluated on.
+func (r *alertRule) records() string {
+	switch r.Type {
+	case ruleTransferAbove:
+		return "transfer"
+	case ruleReorgDeeper:
+		return "reorg"
+	default:
+		return "block"
+	}
+}
+
+// alertEngine evaluates the rules against the records of a watcher. It is a
+// sink, so it sees exactly what the other sinks see.
+type alertEngine struct {
+	rules []*alertRule
+	hook  sink // nil without a webhook
+
+	mu        sync.Mutex
+	lastBlock time.Time // zero until the first block record
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newAlertEngine loads the rules of path for command, which emits the
+// records of the given kinds. Rules on other records could never fire and
+// are rejected.
+func newAlertEngine(path string, opts webhookOptions, command string, kinds []string) (*alertEngine, error) {
+	f, err := loadAlertRules(path)
+	if err != nil {
+		return nil, err
+	}
+	e := &alertEngine{stop: make(chan struct{}), done: make(chan struct{})}
+	for i := range f.Rules {
+		rule := &f.Rules[i]
+		emitted := false
+		for _, kind := range kinds {
+			emitted = emitted || kind == rule.records()
+		}
+		if !emitted {
+			return nil, fmt.Errorf("%s: rule %q (%s) needs %s records, which %s does not emit", path, rule.Name, rule.Type, rule.records(), command)
+		}
+		e.rules = append(e.rules, rule)
+	}
+	if f.Webhook != "" {
+		if e.hook, err = newWebhookSink(f.Webhook, opts); err != nil {
+			return nil, err
+		}
+	}
+	go e.watchStalls()
+	return e, nil
+}
+
+func (e *alertEngine) emit(r record) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch r := r.(type) {
+	case *blockRecord:
+		e.block(r)
+	case *reorgRecord:
+		for _, rule := range e.rules {
+			if rule.Type == ruleReorgDeeper && r.Depth > rule.Depth {
+				e.fire(rule, fmt.Sprintf("reorg of depth %d at block %d", r.Depth, r.Block), r)
+			}
+		}
+	case *transferRecord:
+		if r.Removed {
+			return nil
+		}
+		amount, ok := new(big.Rat).SetString(r.Amount)
+		if !ok {
+			return nil
+		}
+		for _, rule := range e.rules {
+			if rule.Type != ruleTransferAbove || amount.Cmp(rule.amount) <= 0 {
+				continue
+			}
+			if rule.Token != "" && !strings.EqualFold(rule.Token, r.Symbol) &&
+				!(common.IsHexAddress(rule.Token) && common.HexToAddress(rule.Token) == r.Token) {
+				continue
+			}
+			e.fire(rule, fmt.Sprintf("transfer of %s %s from %s to %s in tx %s", r.Amount, r.Symbol, r.From.Hex(), r.To.Hex(), r.TxHash.Hex()), r)
+		}
+	}
+	return nil
+}
+
+func (e *alertEngine) block(r *blockRecord) {
+	e.lastBlock = time.Now()
+	for _, rule := range e.rules {
+		switch rule.Type {
+		case ruleNoNewBlock:
+			if rule.firing {
+				e.resolve(rule, fmt.Sprintf("new block %d", r.Number))
+			}
+		case ruleBaseFeeAbove:
+			baseFee, ok := new(big.Int).SetString(r.BaseFee, 10)
+			if !ok {
+				continue
+			}
+			if above := baseFee.Cmp(rule.baseFee) > 0; above && !rule.firing {
+				e.fire(rule, fmt.Sprintf("base fee %s at block %d", formatGwei(baseFee), r.Number), r)
+			} else if !above && rule.firing {
+				e.resolve(rule, fmt.Sprintf("base fee %s at block %d", formatGwei(baseFee), r.Number))
+			}
+		case ruleGasUtilization:
+			if r.Utilization <= rule.Percent {
+				rule.streak = 0
+				if rule.firing {
+					e.resolve(rule, fmt.Sprintf("gas utilization %.2f%% at block %d", r.Utilization, r.Number))
+				}
+				continue
+			}
+			if rule.streak++; rule.streak >= rule.Blocks && !rule.firing {
+				e.fire(rule, fmt.Sprintf("gas utilization above %.2f%% for %d blocks, up to block %d", rule.Percent, rule.streak, r.Number), r)
+			}
+		}
+	}
+}
+
+// watchStalls fires the no_new_block rules. The clock starts with the
+// first block, so watchers that see no blocks never trigger them.
+func (e *alertEngine) watchStalls() {
+	defer close(e.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.stop:
+			return
+		case now := <-ticker.C:
+			e.mu.Lock()
+			if !e.lastBlock.IsZero() {
+				since := now.Sub(e.lastBlock)
+				for _, rule := range e.rules {
+					if rule.Type == ruleNoNewBlock && !rule.firing && since.Seconds() > rule.Seconds {
+						e.fire(rule, fmt.Sprintf("no new block for %s", since.Round(time.Second)), nil)
+					}
+				}
+			}
+			e.mu.Unlock()
+		}
+	}
+}
+
+func (e *alertEngine) fire(rule *alertRule, message string, data record) {
+	rule.firing = true
+	e.alert(&alertRecord{Rule: rule.Name, RuleType: rule.Type, Severity: rule.Severity, State: "firing", Message: message, Data: data})
+}
+
+func (e *alertEngine) resolve(rule *alertRule, message string) {
+	rule.firing = false
+	e.alert(&alertRecord{Rule: rule.Name, RuleType: rule.Type, Severity: rule.Severity, State: "resolved", Message: message})
+}
+
+func (e *alertEngine) alert(a *alertRecord) {
+	entry := log.WithFields(log.Fields{"rule": a.Rule, "severity": a.Severity, "state": a.State})
+	msg := fmt.Sprintf("Alert %s: %s", a.Rule, a.Message)
+	switch {
+	case a.State == "resolved":
+		entry.Info(msg)
+	case a.Severity == severityCritical:
+		entry.Error(msg)
+	case a.Severity == severityWarning:
+		entry.Warn(msg)
+	default:
+		entry.Info(msg)
+	}
+	if e.hook != nil {
+		if err := e.hook.emit(a); err != nil {
+			log.WithError(err).Warn("Failed to send alert to the webhook")
+		}
+	}
+}
+
+func (e *alertEngine) Close() error {
+	close(e.stop)
+	<-e.done
+	if e.hook != nil {
+		return e.hook.Close()
+	}
+	return nil
+}
+
+// alertRecord is a rule that started or stopped firing, with the record
+// that triggered it, if any.
+type alertRecord struct {
+	Rule     string `json:"rule"`
+	RuleType string `json:"ruleType"`
+	Severity string `json:"severity"`
+	State    string `json:"state"` // firing or resolved
+	Message  string `json:"message"`
+	Data     record `json:"data,omitempty"`
+}
+
+func (a *alertRecord) kind() string { return "alert" }
+
+func (a *alertRecord) writeText(w io.Writer) {
+	fmt.Fprintf(w, "Alert [%s] %s (%s): %s\n", a.Severity, a.Rule, a.State, a.Message)
+}
@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func writeTestRules(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadAlertRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    []alertRule // only the exported fields are compared
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			yaml: "rules:\n  - type: gas_utilization_above\n    percent: 95\n",
+			want: []alertRule{{Name: "gas_utilization_above", Type: ruleGasUtilization, Severity: severityWarning, Percent: 95, Blocks: 1}},
+		},
+		{
+			name: "all types",
+			yaml: `webhook: https://alerts.example.com/hook
+rules:
+  - {name: stalled, type: no_new_block, severity: critical, seconds: 30}
+  - {type: transfer_above, token: USDC, amount: "1000.5"}
+  - {type: base_fee_above, gwei: 100, severity: info}
+  - {type: reorg_depth_above, depth: 2}
+  - {type: gas_utilization_above, percent: 90, blocks: 10}
+`,
+			want: []alertRule{
+				{Name: "stalled", Type: ruleNoNewBlock, Severity: severityCritical, Seconds: 30},
+				{Name: ruleTransferAbove, Type: ruleTransferAbove, Severity: severityWarning, Token: "USDC", Amount: "1000.5"},
+				{Name: ruleBaseFeeAbove, Type: ruleBaseFeeAbove, Severity: severityInfo, Gwei: 100},
+				{Name: ruleReorgDeeper, Type: ruleReorgDeeper, Severity: severityWarning, Depth: 2},
+				{Name: ruleGasUtilization, Type: ruleGasUtilization, Severity: severityWarning, Percent: 90, Blocks: 10},
+			},
+		},
+		{name: "no rules", yaml: "webhook: https://alerts.example.com/hook\n", wantErr: true},
+		{name: "not yaml", yaml: "rules: [", wantErr: true},
+		{name: "unknown type", yaml: "rules:\n  - type: gas_price_above\n", wantErr: true},
+		{name: "unknown severity", yaml: "rules:\n  - {type: reorg_depth_above, severity: page}\n", wantErr: true},
+		{name: "no seconds", yaml: "rules:\n  - type: no_new_block\n", wantErr: true},
+		{name: "no amount", yaml: "rules:\n  - type: transfer_above\n", wantErr: true},
+		{name: "negative amount", yaml: "rules:\n  - {type: transfer_above, amount: \"-1\"}\n", wantErr: true},
+		{name: "no gwei", yaml: "rules:\n  - type: base_fee_above\n", wantErr: true},
+		{name: "no percent", yaml: "rules:\n  - type: gas_utilization_above\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		f, err := loadAlertRules(writeTestRules(t, tt.yaml))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		var got []alertRule
+		for _, r := range f.Rules {
+			got = append(got, alertRule{Name: r.Name, Type: r.Type, Severity: r.Severity, Seconds: r.Seconds, Token: r.Token,
+				Amount: r.Amount, Gwei: r.Gwei, Depth: r.Depth, Percent: r.Percent, Blocks: r.Blocks})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: rules = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAlertEngineKinds(t *testing.T) {
+	rules := writeTestRules(t, `rules:
+  - {type: transfer_above, amount: "1"}
+  - {type: reorg_depth_above, depth: 2}
+`)
+	tests := []struct {
+		command string
+		kinds   []string
+		wantErr bool
+	}{
+		{command: "newblock", kinds: []string{"block", "reorg"}, wantErr: true},
+		{command: "transfer", kinds: []string{"transfer"}, wantErr: true},
+		{command: "mempool", kinds: []string{"mempool"}, wantErr: true},
+		{command: "all", kinds: []string{"block", "reorg", "transfer"}},
+	}
+	for _, tt := range tests {
+		e, err := newAlertEngine(rules, webhookOptions{}, tt.command, tt.kinds)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.command, err, tt.wantErr)
+		}
+		if e != nil {
+			e.Close()
+		}
+	}
+}
+
+// testSink keeps the records emitted to it.
+type testSink struct {
+	mu      sync.Mutex
+	records []record
+}
+
+func (s *testSink) emit(r record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *testSink) Close() error { return nil }
+
+// states returns the state of every alert emitted so far.
+func (s *testSink) states() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var states []string
+	for _, r := range s.records {
+		states = append(states, r.(*alertRecord).State)
+	}
+	return states
+}
+
+func TestAlertTransitions(t *testing.T) {
+	gwei := func(v int64) string { return new(big.Int).Mul(big.NewInt(v), big.NewInt(1e9)).String() }
+	block := func(baseFeeGwei int64, utilization float64) record {
+		return &blockRecord{BaseFee: gwei(baseFeeGwei), Utilization: utilization}
+	}
+	usdc := common.HexToAddress("0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48")
+	transfer := func(symbol, amount string, removed bool) record {
+		token := common.Address{}
+		if symbol == "USDC" {
+			token = usdc
+		}
+		return &transferRecord{Token: token, Symbol: symbol, Amount: amount, Removed: removed}
+	}
+	tests := []struct {
+		name    string
+		rule    string
+		records []record
+		want    []string
+	}{
+		{
+			name:    "base fee fires and resolves once per crossing",
+			rule:    "{type: base_fee_above, gwei: 100}",
+			records: []record{block(50, 0), block(150, 0), block(200, 0), block(80, 0), block(120, 0)},
+			want:    []string{"firing", "resolved", "firing"},
+		},
+		{
+			name:    "gas utilization needs a streak",
+			rule:    "{type: gas_utilization_above, percent: 90, blocks: 2}",
+			records: []record{block(0, 95), block(0, 80), block(0, 95), block(0, 96), block(0, 97), block(0, 50)},
+			want:    []string{"firing", "resolved"},
+		},
+		{
+			name:    "reorg fires on every deep reorg",
+			rule:    "{type: reorg_depth_above, depth: 2}",
+			records: []record{&reorgRecord{Depth: 1}, &reorgRecord{Depth: 3}, &reorgRecord{Depth: 2}, &reorgRecord{Depth: 5}},
+			want:    []string{"firing", "firing"},
+		},
+		{
+			name: "transfer by symbol",
+			rule: "{type: transfer_above, token: usdc, amount: \"1000\"}",
+			records: []record{transfer("USDC", "500", false), transfer("USDC", "1000.01", false),
+				transfer("DAI", "5000", false), transfer("USDC", "2000", true)},
+			want: []string{"firing"},
+		},
+		{
+			name:    "transfer by address",
+			rule:    "{type: transfer_above, token: \"" + usdc.Hex() + "\", amount: \"1\"}",
+			records: []record{transfer("USDC", "2", false), transfer("DAI", "2", false)},
+			want:    []string{"firing"},
+		},
+		{
+			name:    "transfer of any token",
+			rule:    "{type: transfer_above, amount: \"1\"}",
+			records: []record{transfer("USDC", "2", false), transfer("DAI", "2", false), transfer("DAI", "1", false)},
+			want:    []string{"firing", "firing"},
+		},
+	}
+	for _, tt := range tests {
+		f, err := loadAlertRules(writeTestRules(t, "rules:\n  - "+tt.rule+"\n"))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		hook := &testSink{}
+		e := &alertEngine{rules: []*alertRule{&f.Rules[0]}, hook: hook}
+		for _, r := range tt.records {
+			if err := e.emit(r); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if got := hook.states(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: alerts %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAlertNoNewBlock(t *testing.T) {
+	e, err := newAlertEngine(writeTestRules(t, "rules:\n  - {type: no_new_block, seconds: 0.5}\n"), webhookOptions{}, "newblock", []string{"block"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := &testSink{}
+	e.hook = hook
+	defer e.Close()
+
+	// The clock only starts with the first block.
+	time.Sleep(1200 * time.Millisecond)
+	if got := hook.states(); len(got) != 0 {
+		t.Fatalf("alerts %v before the first block", got)
+	}
+	e.emit(&blockRecord{Number: 1})
+	time.Sleep(2200 * time.Millisecond)
+	e.emit(&blockRecord{Number: 2})
+	if got, want := hook.states(), []string{"firing", "resolved"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alerts %v, want %v", got, want)
+	}
+}
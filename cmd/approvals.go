@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/xueqianLu/ethtools/erc20"
+)
+
+const (
+	OwnerFlag   = "owner"
+	SpenderFlag = "spender"
+)
+
+// approvalsCmd represents the approvals command
+var approvalsCmd = &cobra.Command{
+	Use:   "approvals",
+	Short: "Watch Approval events of an ERC-20 token, or build its allowance table for a block range",
+	Run: func(cmd *cobra.Command, args []string) {
+		chainEndpoint, _ := cmd.Flags().GetString(ChainEndpointFlag)
+		contractAddressStr, _ := cmd.Flags().GetString(ContractAddressFlag)
+		ownerStrs, _ := cmd.Flags().GetStringSlice(OwnerFlag)
+		spenderStrs, _ := cmd.Flags().GetStringSlice(SpenderFlag)
+		fromBlock, _ := cmd.Flags().GetUint64(FromBlockFlag)
+		toBlockStr, _ := cmd.Flags().GetString(ToBlockFlag)
+		if chainEndpoint == "" {
+			log.Error("Chain endpoint is required")
+			return
+		}
+		if !common.IsHexAddress(contractAddressStr) {
+			log.Error("A valid --token-address is required")
+			return
+		}
+		owners, err := loadAddresses(ownerStrs, "")
+		if err != nil {
+			log.WithError(err).Error("Invalid --owner")
+			return
+		}
+		spenders, err := loadAddresses(spenderStrs, "")
+		if err != nil {
+			log.WithError(err).Error("Invalid --spender")
+			return
+		}
+		toBlock, err := parseBlockSpec(toBlockStr)
+		if err != nil {
+			log.WithError(err).Error("Invalid --to-block")
+			return
+		}
+		if !toBlock.isTag() && toBlock.number < fromBlock {
+			log.Errorf("--to-block (%d) < --from-block (%d)", toBlock.number, fromBlock)
+			return
+		}
+
+		err = doApprovals(cmd.Context(), chainEndpoint, common.HexToAddress(contractAddressStr), approvalsOptions{
+			owners:    owners,
+			spenders:  spenders,
+			fromBlock: fromBlock,
+			toBlock:   toBlock,
+		})
+		if err != nil && !stopped(cmd) {
+			log.WithError(err).Error("approvals failed")
+			return
+		}
+	},
+}
+
+func init() {
+	approvalsCmd.Flags().String(ChainEndpointFlag, "", "Chain endpoint URL")
+	approvalsCmd.Flags().String(ContractAddressFlag, "", "ERC-20 contract address")
+	approvalsCmd.Flags().StringSlice(OwnerFlag, nil, "Only show approvals by this owner (repeatable)")
+	approvalsCmd.Flags().StringSlice(SpenderFlag, nil, "Only show approvals to this spender (repeatable)")
+	approvalsCmd.Flags().Uint64(FromBlockFlag, 0, "Build the allowance table of every owner/spender pair approved since this block instead of streaming. 0 streams new approvals")
+	approvalsCmd.Flags().String(ToBlockFlag, "0", "Last block (inclusive) scanned for the allowance table: a block number or latest|finalized|safe. 0 means latest")
+	_ = approvalsCmd.MarkFlagRequired(ContractAddressFlag)
+
+	rootCmd.AddCommand(approvalsCmd)
+}
+
+type approvalsOptions struct {
+	owners    []common.Address
+	spenders  []common.Address
+	fromBlock uint64 // 0 streams new approvals
+	toBlock   blockSpec
+}
+
+// isUnlimited reports whether an allowance is an "unlimited" approval.
+// Wallets approve type(uint256).max, and tokens that still decrement such
+// an allowance leave it with the top bit set for any realistic spending.
+func isUnlimited(v *big.Int) bool {
+	return v.BitLen() == 256
+}
+
+func doApprovals(ctx context.Context, endpoint string, tokenAddress common.Address, opts approvalsOptions) error {
+	client, err := ethclient.DialContext(ctx, endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the Ethereum client: %w", err)
+	}
+	defer client.Close()
+
+	contract, err := erc20.NewErc20(tokenAddress, client)
+	if err != nil {
+		return err
+	}
+	token := loadTokenInfo(ctx, contract, tokenAddress)
+	if opts.fromBlock == 0 {
+		return watchApprovals(ctx, contract, token, opts)
+	}
+	return allowanceTable(ctx, client, contract, token, opts)
+}
+
+func watchApprovals(ctx context.Context, contract *erc20.Erc20, token tokenInfo, opts approvalsOptions) error {
+	events := make(chan *erc20.Erc20Approval)
+	sub, err := contract.WatchApproval(&bind.WatchOpts{Context: ctx}, events, opts.owners, opts.spenders)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to Approval events: %w", err)
+	}
+	defer sub.Unsubscribe()
+
+	var counts approvalCounts
+	defer func() {
+		log.Infof("approvals summary: events=%d unlimited=%d", counts.events, counts.unlimited)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-sub.Err():
+			return err
+		case event := <-events:
+			fmt.Println("Approval Event:")
+			fmt.Println("Block Number:", event.Raw.BlockNumber)
+			fmt.Println("Transaction Hash:", event.Raw.TxHash.Hex())
+			fmt.Println("Contract Address:", event.Raw.Address.Hex())
+			fmt.Println("Owner:", event.Owner.Hex())
+			fmt.Println("Spender:", event.Spender.Hex())
+			counts.add(event)
+			if isUnlimited(event.Value) {
+				fmt.Println("Value: unlimited")
+			} else {
+				fmt.Println("Value:", token.format(event.Value))
+			}
+			if event.Raw.Removed {
+				fmt.Println("Removed: true")
+			}
+		}
+	}
+}
+
+// approvalCounts counts the Approval events watched, less those a reorg
+// removed again.
+type approvalCounts struct {
+	events, unlimited int
+}
+
+func (c *approvalCounts) add(event *erc20.Erc20Approval) {
+	n := 1
+	if event.Raw.Removed {
+		n = -1
+	}
+	c.events += n
+	if isUnlimited(event.Value) {
+		c.unlimited += n
+	}
+}
+
+// allowanceTable collects every owner/spender pair approved in the block
+// range and prints the current allowance of each pair that still has one.
+func allowanceTable(ctx context.Context, client *ethclient.Client, contract *erc20.Erc20, token tokenInfo, opts approvalsOptions) error {
+	to, err := opts.toBlock.resolve(ctx, client, 0)
+	if err != nil {
+		return err
+	}
+	if to < opts.fromBlock {
+		return fmt.Errorf("--to-block %s resolved to %d, before --from-block %d", opts.toBlock, to, opts.fromBlock)
+	}
+
+	type pair struct {
+		owner, spender common.Address
+	}
+	lastApproved := make(map[pair]uint64)
+	for start := opts.fromBlock; start <= to; start += MaxBlocksPerRequest {
+		end := start + MaxBlocksPerRequest - 1
+		if end > to {
+			end = to
+		}
+		it, err := contract.FilterApproval(&bind.FilterOpts{Start: start, End: &end, Context: ctx}, opts.owners, opts.spenders)
+		if err != nil {
+			return fmt.Errorf("FilterApproval [%d..%d]: %w", start, end, err)
+		}
+		for it.Next() {
+			lastApproved[pair{it.Event.Owner, it.Event.Spender}] = it.Event.Raw.BlockNumber
+		}
+		err = it.Error()
+		it.Close()
+		if err != nil {
+			return fmt.Errorf("FilterApproval [%d..%d]: %w", start, end, err)
+		}
+	}
+	log.Infof("Found %d owner/spender pairs approved in blocks %d..%d", len(lastApproved), opts.fromBlock, to)
+
+	pairs := make([]pair, 0, len(lastApproved))
+	for p := range lastApproved {
+		pairs = append(pairs, p)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].owner != pairs[j].owner {
+			return pairs[i].owner.Hex() < pairs[j].owner.Hex()
+		}
+		return pairs[i].spender.Hex() < pairs[j].spender.Hex()
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OWNER\tSPENDER\tALLOWANCE\tLAST APPROVAL\tRISK")
+	var active, unlimited int
+	for _, p := range pairs {
+		allowance, err := contract.Allowance(&bind.CallOpts{Context: ctx}, p.owner, p.spender)
+		if err != nil {
+			return fmt.Errorf("allowance(%s, %s): %w", p.owner.Hex(), p.spender.Hex(), err)
+		}
+		if allowance.Sign() == 0 {
+			continue
+		}
+		active++
+		amount, risk := token.format(allowance), ""
+		if isUnlimited(allowance) {
+			amount, risk = "unlimited", "UNLIMITED"
+			unlimited++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", p.owner.Hex(), p.spender.Hex(), amount, lastApproved[p], risk)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	log.Infof("approvals summary: pairs=%d active=%d unlimited=%d", len(pairs), active, unlimited)
+	return nil
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/xueqianLu/ethtools/erc20"
+)
+
+func TestApprovalCounts(t *testing.T) {
+	approval := func(value *big.Int, removed bool) *erc20.Erc20Approval {
+		return &erc20.Erc20Approval{Value: value, Raw: types.Log{Removed: removed}}
+	}
+	limited, unlimited := big.NewInt(1000), math.MaxBig256
+	tests := []struct {
+		name   string
+		events []*erc20.Erc20Approval
+		want   approvalCounts
+	}{
+		{name: "none"},
+		{name: "limited", events: []*erc20.Erc20Approval{approval(limited, false)}, want: approvalCounts{events: 1}},
+		{name: "unlimited", events: []*erc20.Erc20Approval{approval(limited, false), approval(unlimited, false)}, want: approvalCounts{events: 2, unlimited: 1}},
+		{
+			name:   "unlimited reorged away",
+			events: []*erc20.Erc20Approval{approval(limited, false), approval(unlimited, false), approval(unlimited, true)},
+			want:   approvalCounts{events: 1},
+		},
+		{
+			name:   "limited reorged away and included again",
+			events: []*erc20.Erc20Approval{approval(limited, false), approval(limited, true), approval(limited, false)},
+			want:   approvalCounts{events: 1},
+		},
+	}
+	for _, tt := range tests {
+		var got approvalCounts
+		for _, event := range tt.events {
+			got.add(event)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// blockInfo holds the per-block figures newblock prints on top of the block
+// number, hash and timestamp.
+type blockInfo struct {
+	gasUsed     uint64
+	gasLimit    uint64
+	baseFee     *big.Int // nil before London
+	legacy      int
+	accessList  int
+	dynamicFee  int
+	otherTxs    int
+	interval    uint64 // seconds since the parent, valid if hasInterval
+	hasInterval bool
+}
+
+func newBlockInfo(block *types.Block, parent *types.Header) blockInfo {
+	info := blockInfo{
+		gasUsed:  block.GasUsed(),
+		gasLimit: block.GasLimit(),
+		baseFee:  block.BaseFee(),
+	}
+	for _, tx := range block.Transactions() {
+		switch tx.Type() {
+		case types.LegacyTxType:
+			info.legacy++
+		case types.AccessListTxType:
+			info.accessList++
+		case types.DynamicFeeTxType:
+			info.dynamicFee++
+		default:
+			info.otherTxs++
+		}
+	}
+	if parent != nil && block.Time() >= parent.Time {
+		info.interval = block.Time() - parent.Time
+		info.hasInterval = true
+	}
+	return info
+}
+
+// utilization returns gas used as a percentage of the gas limit.
+func (b blockInfo) utilization() float64 {
+	if b.gasLimit == 0 {
+		return 0
+	}
+	return float64(b.gasUsed) * 100 / float64(b.gasLimit)
+}
+
+func (b blockInfo) txTypes() string {
+	s := fmt.Sprintf("legacy=%d accessList=%d dynamicFee=%d", b.legacy, b.accessList, b.dynamicFee)
+	if b.otherTxs > 0 {
+		s += fmt.Sprintf(" other=%d", b.otherTxs)
+	}
+	return s
+}
+
+// blockRecord is the newblock output for one block.
+type blockRecord struct {
+	Number      uint64         `json:"number"`
+	Hash        common.Hash    `json:"hash"`
+	Timestamp   uint64         `json:"timestamp"`
+	Interval    *uint64        `json:"interval,omitempty"` // seconds since the parent
+	Miner       common.Address `json:"miner"`
+	GasUsed     uint64         `json:"gasUsed"`
+	GasLimit    uint64         `json:"gasLimit"`
+	Utilization float64        `json:"gasUtilization"`    // percent
+	BaseFee     string         `json:"baseFee,omitempty"` // wei
+	Txs         int            `json:"txs"`
+	TxTypes     map[string]int `json:"txTypes"`
+
+	info blockInfo
+}
+
+func newBlockRecord(block *types.Block, info blockInfo) *blockRecord {
+	r := &blockRecord{
+		Number:      block.NumberU64(),
+		Hash:        block.Hash(),
+		Timestamp:   block.Time(),
+		Miner:       block.Coinbase(),
+		GasUsed:     info.gasUsed,
+		GasLimit:    info.gasLimit,
+		Utilization: info.utilization(),
+		Txs:         len(block.Transactions()),
+		TxTypes: map[string]int{
+			"legacy":     info.legacy,
+			"accessList": info.accessList,
+			"dynamicFee": info.dynamicFee,
+		},
+		info: info,
+	}
+	if info.otherTxs > 0 {
+		r.TxTypes["other"] = info.otherTxs
+	}
+	if info.hasInterval {
+		interval := info.interval
+		r.Interval = &interval
+	}
+	if info.baseFee != nil {
+		r.BaseFee = info.baseFee.String()
+	}
+	return r
+}
+
+func (r *blockRecord) kind() string { return "block" }
+
+func (r *blockRecord) writeText(w io.Writer) {
+	fmt.Fprintln(w, "New block mined:", r.Number)
+	fmt.Fprintln(w, "Block Number:", r.Number)
+	fmt.Fprintln(w, "Block Hash:", r.Hash.Hex())
+	fmt.Fprintln(w, "Block Timestamp:", r.Timestamp)
+	if r.Interval != nil {
+		fmt.Fprintln(w, "Block Interval:", secs(*r.Interval))
+	}
+	fmt.Fprintln(w, "Miner:", r.Miner.Hex())
+	fmt.Fprintf(w, "Gas Used: %d / %d (%.2f%%)\n", r.GasUsed, r.GasLimit, r.Utilization)
+	fmt.Fprintln(w, "Base Fee:", formatGwei(r.info.baseFee))
+	fmt.Fprintln(w, "Number of Transactions:", r.Txs)
+	fmt.Fprintln(w, "Transaction Types:", r.info.txTypes())
+}
+
+// formatGwei renders a wei amount in gwei, or n/a for a missing value.
+func formatGwei(wei *big.Int) string {
+	if wei == nil {
+		return "n/a"
+	}
+	gwei := new(big.Float).Quo(new(big.Float).SetInt(wei), big.NewFloat(params.GWei))
+	return gwei.Text('f', 3) + " gwei"
+}
+
+// blockStats accumulates the figures of the printed blocks for the summary
+// newblock prints when it stops. Blocks are kept by number, so a block
+// printed again after a reorg replaces the one it reorged away.
+type blockStats struct {
+	blocks map[uint64]blockSample
+}
+
+type blockSample struct {
+	txs         int64
+	utilization float64
+	time        uint64
+	interval    uint64 // valid if hasInterval
+	hasInterval bool
+}
+
+func (s *blockStats) add(block *types.Block, info blockInfo) {
+	if s.blocks == nil {
+		s.blocks = make(map[uint64]blockSample)
+	}
+	s.blocks[block.NumberU64()] = blockSample{
+		txs:         int64(len(block.Transactions())),
+		utilization: info.utilization(),
+		time:        block.Time(),
+		interval:    info.interval,
+		hasInterval: info.hasInterval,
+	}
+}
+
+// summaryRecord is the newblock summary of all printed blocks.
+type summaryRecord struct {
+	Blocks         int64   `json:"blocks"`
+	Txs            int64   `json:"txs"`
+	MinBlockTime   float64 `json:"minBlockTime,omitempty"` // seconds
+	AvgBlockTime   float64 `json:"avgBlockTime,omitempty"`
+	P95BlockTime   float64 `json:"p95BlockTime,omitempty"`
+	AvgUtilization float64 `json:"avgGasUtilization"`    // percent
+	Throughput     float64 `json:"throughput,omitempty"` // tx/s
+
+	hasBlockTime bool
+}
+
+// summary returns the summary of the blocks added so far, nil if none.
+func (s *blockStats) summary() *summaryRecord {
+	if len(s.blocks) == 0 {
+		return nil
+	}
+	numbers := make([]uint64, 0, len(s.blocks))
+	for n := range s.blocks {
+		numbers = append(numbers, n)
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	r := &summaryRecord{Blocks: int64(len(numbers))}
+	var utilization float64
+	var intervals []uint64
+	for _, n := range numbers {
+		b := s.blocks[n]
+		r.Txs += b.txs
+		utilization += b.utilization
+		if b.hasInterval {
+			intervals = append(intervals, b.interval)
+		}
+	}
+	r.AvgUtilization = utilization / float64(len(numbers))
+	if len(intervals) > 0 {
+		sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+		var sum uint64
+		for _, v := range intervals {
+			sum += v
+		}
+		r.hasBlockTime = true
+		r.MinBlockTime = float64(intervals[0])
+		r.AvgBlockTime = float64(sum) / float64(len(intervals))
+		// Nearest-rank percentile.
+		r.P95BlockTime = float64(intervals[(len(intervals)*95+99)/100-1])
+	}
+	// The transactions of the first block were produced before the
+	// measured span started.
+	first, last := s.blocks[numbers[0]], s.blocks[numbers[len(numbers)-1]]
+	if last.time > first.time {
+		r.Throughput = float64(r.Txs-first.txs) / float64(last.time-first.time)
+	}
+	return r
+}
+
+func (r *summaryRecord) kind() string { return "summary" }
+
+func (r *summaryRecord) writeText(w io.Writer) {
+	seconds := func(v float64) time.Duration {
+		return time.Duration(v * float64(time.Second)).Round(time.Millisecond)
+	}
+	fmt.Fprintln(w, "Summary:")
+	fmt.Fprintln(w, "Blocks:", r.Blocks)
+	fmt.Fprintln(w, "Transactions:", r.Txs)
+	if r.hasBlockTime {
+		fmt.Fprintf(w, "Block Time: min=%s avg=%s p95=%s\n", seconds(r.MinBlockTime), seconds(r.AvgBlockTime), seconds(r.P95BlockTime))
+	}
+	fmt.Fprintf(w, "Average Gas Utilization: %.2f%%\n", r.AvgUtilization)
+	if r.Throughput > 0 {
+		fmt.Fprintf(w, "Throughput: %.2f tx/s\n", r.Throughput)
+	}
+}
+
+func secs(v uint64) time.Duration {
+	return time.Duration(v) * time.Second
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// testBlock is a block added to blockStats: its number, time, transaction
+// count and gas used out of 100, and the interval to its parent, 0 for none.
+type testBlock struct {
+	number, time uint64
+	txs          int
+	gasUsed      uint64
+	interval     uint64
+}
+
+func (b testBlock) add(s *blockStats) {
+	txs := make([]*types.Transaction, b.txs)
+	for i := range txs {
+		txs[i] = types.NewTx(&types.LegacyTx{Nonce: uint64(i)})
+	}
+	header := &types.Header{Number: new(big.Int).SetUint64(b.number), Time: b.time, GasUsed: b.gasUsed, GasLimit: 100}
+	block := types.NewBlockWithHeader(header).WithBody(txs, nil)
+	s.add(block, blockInfo{gasUsed: b.gasUsed, gasLimit: 100, interval: b.interval, hasInterval: b.interval > 0})
+}
+
+func TestBlockStatsSummary(t *testing.T) {
+	// chain returns n blocks from number 1 at time 1000, each with txs
+	// transactions and full, the first with firstTxs, and the intervals
+	// between them 1..n-1 in random order.
+	chain := func(n, firstTxs, txs int) []testBlock {
+		blocks := []testBlock{{number: 1, time: 1000, txs: firstTxs, gasUsed: 100}}
+		for _, i := range rand.Perm(n - 1) {
+			prev := blocks[len(blocks)-1]
+			interval := uint64(i + 1)
+			blocks = append(blocks, testBlock{number: prev.number + 1, time: prev.time + interval, txs: txs, gasUsed: 100, interval: interval})
+		}
+		return blocks
+	}
+	tests := []struct {
+		name   string
+		blocks []testBlock
+		want   *summaryRecord
+	}{
+		{name: "no blocks"},
+		{
+			name:   "one block",
+			blocks: []testBlock{{number: 1, time: 100, txs: 5, gasUsed: 40}},
+			want:   &summaryRecord{Blocks: 1, Txs: 5, AvgUtilization: 40},
+		},
+		{
+			name:   "one interval",
+			blocks: []testBlock{{number: 1, time: 100, txs: 10, gasUsed: 40}, {number: 2, time: 112, txs: 20, gasUsed: 60, interval: 12}},
+			want:   &summaryRecord{Blocks: 2, Txs: 30, MinBlockTime: 12, AvgBlockTime: 12, P95BlockTime: 12, AvgUtilization: 50, Throughput: 20.0 / 12, hasBlockTime: true},
+		},
+		{
+			name:   "21 blocks",
+			blocks: chain(21, 10, 105),
+			want:   &summaryRecord{Blocks: 21, Txs: 2110, MinBlockTime: 1, AvgBlockTime: 10.5, P95BlockTime: 19, AvgUtilization: 100, Throughput: 10, hasBlockTime: true},
+		},
+		{
+			name:   "101 blocks",
+			blocks: chain(101, 0, 0),
+			want:   &summaryRecord{Blocks: 101, MinBlockTime: 1, AvgBlockTime: 50.5, P95BlockTime: 95, AvgUtilization: 100, hasBlockTime: true},
+		},
+		{
+			name: "reorged blocks replaced",
+			blocks: []testBlock{
+				{number: 1, time: 100, txs: 10, gasUsed: 40},
+				{number: 2, time: 112, txs: 20, gasUsed: 60, interval: 12},
+				{number: 3, time: 124, txs: 90, gasUsed: 90, interval: 12},
+				// Blocks 2 and 3 printed again on the new branch.
+				{number: 2, time: 104, txs: 30, gasUsed: 20, interval: 4},
+				{number: 3, time: 112, txs: 30, gasUsed: 60, interval: 8},
+			},
+			want: &summaryRecord{Blocks: 3, Txs: 70, MinBlockTime: 4, AvgBlockTime: 6, P95BlockTime: 8, AvgUtilization: 40, Throughput: 5, hasBlockTime: true},
+		},
+	}
+	for _, tt := range tests {
+		var stats blockStats
+		for _, b := range tt.blocks {
+			b.add(&stats)
+		}
+		got := stats.summary()
+		if (got == nil) != (tt.want == nil) {
+			t.Errorf("%s: summary() = %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		if got != nil && *got != *tt.want {
+			t.Errorf("%s: summary() = %+v, want %+v", tt.name, *got, *tt.want)
+		}
+	}
+}
@@ -37,11 +37,11 @@ var chainPareCmd = &cobra.Command{
 			log.Errorf("Account file is required")
 			return
 		}
-		doCompare(chain1, chain2, accountFile)
+		doCompare(cmd.Context(), chain1, chain2, accountFile)
 	},
 }
 
-func doCompare(chain1, chain2, accountFile string) {
+func doCompare(ctx context.Context, chain1, chain2, accountFile string) {
 	// do compare
 	clientChain1, err := ethclient.Dial(chain1)
 	if err != nil {
@@ -65,7 +65,6 @@ func doCompare(chain1, chain2, accountFile string) {
 		}
 	}
 	//height := big.NewInt(610013)
-	ctx := context.TODO()
 	for _, address := range addresslist {
 		addr := common.HexToAddress(address)
 		balance1, err := clientChain1.BalanceAt(ctx, addr, nil)
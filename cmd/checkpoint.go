@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	CheckpointIntervalFlag = "checkpoint-interval"
+	CheckpointFileFlag     = "checkpoint-file"
+	CheckpointFile1Flag    = "checkpoint-file-1"
+	CheckpointFile2Flag    = "checkpoint-file-2"
+	File1Flag              = "file-1"
+	File2Flag              = "file-2"
+)
+
+// checkpointVersion is the version of the checkpoint file format. Readers
+// refuse files with a different version.
+const checkpointVersion = 1
+
+// compareCheckpointsCmd represents the compare checkpoints command
+var compareCheckpointsCmd = &cobra.Command{
+	Use:   "comparecheckpoints",
+	Short: "Compare two checkpoint files and report the first span whose logs differ",
+	Run: func(cmd *cobra.Command, args []string) {
+		file1, _ := cmd.Flags().GetString(File1Flag)
+		file2, _ := cmd.Flags().GetString(File2Flag)
+		if file1 == "" || file2 == "" {
+			log.Error("Both --file-1 and --file-2 are required")
+			return
+		}
+		if err := doCompareCheckpoints(file1, file2); err != nil {
+			log.WithError(err).Error("comparecheckpoints failed")
+			return
+		}
+	},
+}
+
+func init() {
+	compareCheckpointsCmd.Flags().String(File1Flag, "", "The first checkpoint file")
+	compareCheckpointsCmd.Flags().String(File2Flag, "", "The second checkpoint file")
+	_ = compareCheckpointsCmd.MarkFlagRequired(File1Flag)
+	_ = compareCheckpointsCmd.MarkFlagRequired(File2Flag)
+
+	rootCmd.AddCommand(compareCheckpointsCmd)
+}
+
+// logDigest is the rolling digest of all logs up to some block. Every block
+// with logs chains its canonical logs onto the previous digest, so once two
+// chains differ their digests never agree again and the first differing
+// block can be found by bisection.
+type logDigest struct {
+	hash common.Hash
+	logs uint64
+}
+
+func (d logDigest) next(block uint64, canon []string) logDigest {
+	var num [8]byte
+	binary.BigEndian.PutUint64(num[:], block)
+
+	h := sha256.New()
+	h.Write(d.hash[:])
+	h.Write(num[:])
+	h.Write([]byte(strings.Join(canon, "\n")))
+
+	var res logDigest
+	copy(res.hash[:], h.Sum(nil))
+	res.logs = d.logs + uint64(len(canon))
+	return res
+}
+
+// digestPoint is the rolling digest right after a block that had logs.
+type digestPoint struct {
+	block  uint64
+	digest logDigest
+}
+
+// digestLogs chains logs, which must be ordered by block, onto base and
+// returns the final digest together with one point per block with logs.
+func digestLogs(base logDigest, logs []types.Log, ignoreOrder bool) (logDigest, []digestPoint) {
+	var points []digestPoint
+	d := base
+	for i := 0; i < len(logs); {
+		j := i
+		for j < len(logs) && logs[j].BlockNumber == logs[i].BlockNumber {
+			j++
+		}
+		d = d.next(logs[i].BlockNumber, canonicalizeLogs(logs[i:j], ignoreOrder))
+		points = append(points, digestPoint{block: logs[i].BlockNumber, digest: d})
+		i = j
+	}
+	return d, points
+}
+
+// digestAt returns the digest right after block b, given the digest before
+// the first of points.
+func digestAt(base logDigest, points []digestPoint, b uint64) logDigest {
+	i := sort.Search(len(points), func(i int) bool { return points[i].block > b })
+	if i == 0 {
+		return base
+	}
+	return points[i-1].digest
+}
+
+// isCheckpoint reports whether block is a checkpoint for the given interval.
+// Checkpoints sit on multiples of the interval so that files produced by
+// different runs or tools line up.
+func isCheckpoint(block, interval uint64) bool {
+	return interval > 0 && block%interval == 0
+}
+
+// checkpointHeader is the first line of a checkpoint file.
+type checkpointHeader struct {
+	Version     int              `json:"version"`
+	ChainID     *big.Int         `json:"chainId,omitempty"`
+	GenesisHash common.Hash      `json:"genesisHash"`
+	FromBlock   uint64           `json:"fromBlock"`
+	Interval    uint64           `json:"interval"`
+	IgnoreOrder bool             `json:"ignoreOrder"`
+	Addresses   []common.Address `json:"addresses,omitempty"`
+	Topics      [][]common.Hash  `json:"topics,omitempty"`
+}
+
+// checkpointEntry is every following line of a checkpoint file. If a block
+// appears more than once, for example because it was recomputed after a
+// reorg, the last entry wins.
+type checkpointEntry struct {
+	Block  uint64      `json:"block"`
+	Digest common.Hash `json:"digest"`
+	Logs   uint64      `json:"logs"`
+}
+
+// compatible reports why two checkpoint files cannot be compared, if so.
+func (h checkpointHeader) compatible(o checkpointHeader) error {
+	if h.FromBlock != o.FromBlock {
+		return fmt.Errorf("different start blocks: %d vs %d", h.FromBlock, o.FromBlock)
+	}
+	if h.IgnoreOrder != o.IgnoreOrder {
+		return fmt.Errorf("different ignore-order settings: %v vs %v", h.IgnoreOrder, o.IgnoreOrder)
+	}
+	f1, _ := json.Marshal([]interface{}{h.Addresses, h.Topics})
+	f2, _ := json.Marshal([]interface{}{o.Addresses, o.Topics})
+	if string(f1) != string(f2) {
+		return fmt.Errorf("different filters: %s vs %s", f1, f2)
+	}
+	return nil
+}
+
+// checkpointWriter appends entries to a checkpoint file. Every entry is
+// written straight through so an interrupted run keeps what it has done.
+type checkpointWriter struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+func createCheckpointFile(path string, header checkpointHeader) (*checkpointWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	cw := &checkpointWriter{f: f, enc: json.NewEncoder(f)}
+	header.Version = checkpointVersion
+	if err := cw.enc.Encode(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *checkpointWriter) write(block uint64, d logDigest) error {
+	return cw.enc.Encode(checkpointEntry{Block: block, Digest: d.hash, Logs: d.logs})
+}
+
+func (cw *checkpointWriter) Close() error {
+	return cw.f.Close()
+}
+
+// loadCheckpointFile reads a checkpoint file and returns its entries ordered
+// by block.
+func loadCheckpointFile(path string) (checkpointHeader, []checkpointEntry, error) {
+	var header checkpointHeader
+	f, err := os.Open(path)
+	if err != nil {
+		return header, nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return header, nil, err
+		}
+		return header, nil, fmt.Errorf("%s: empty checkpoint file", path)
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &header); err != nil {
+		return header, nil, fmt.Errorf("%s: header: %w", path, err)
+	}
+	if header.Version != checkpointVersion {
+		return header, nil, fmt.Errorf("%s: unsupported checkpoint version %d (want %d)", path, header.Version, checkpointVersion)
+	}
+
+	byBlock := make(map[uint64]checkpointEntry)
+	for line := 2; scanner.Scan(); line++ {
+		var e checkpointEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return header, nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		byBlock[e.Block] = e
+	}
+	if err := scanner.Err(); err != nil {
+		return header, nil, err
+	}
+
+	entries := make([]checkpointEntry, 0, len(byBlock))
+	for _, e := range byBlock {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Block < entries[j].Block })
+	return header, entries, nil
+}
+
+func doCompareCheckpoints(file1, file2 string) error {
+	h1, e1, err := loadCheckpointFile(file1)
+	if err != nil {
+		return err
+	}
+	h2, e2, err := loadCheckpointFile(file2)
+	if err != nil {
+		return err
+	}
+	if err := h1.compatible(h2); err != nil {
+		return fmt.Errorf("checkpoint files are not comparable: %w", err)
+	}
+	if h1.ChainID != nil && h2.ChainID != nil && h1.ChainID.Cmp(h2.ChainID) != 0 {
+		log.Warnf("Checkpoint files come from different chain ids: %s vs %s", h1.ChainID, h2.ChainID)
+	}
+
+	second := make(map[uint64]checkpointEntry, len(e2))
+	for _, e := range e2 {
+		second[e.Block] = e
+	}
+
+	agreed := h1.FromBlock - 1
+	var compared uint64
+	for _, a := range e1 {
+		b, ok := second[a.Block]
+		if !ok {
+			continue
+		}
+		compared++
+		if a.Digest == b.Digest {
+			log.Debugf("[checkpoint %d] digests equal. logs=%d digest=%s", a.Block, a.Logs, a.Digest.Hex())
+			agreed = a.Block
+			continue
+		}
+
+		log.Errorf("[checkpoint %d] digests differ (file1=%s logs=%d, file2=%s logs=%d)", a.Block, a.Digest.Hex(), a.Logs, b.Digest.Hex(), b.Logs)
+		log.Errorf("First difference is in blocks %d..%d", agreed+1, a.Block)
+		if span := a.Block - agreed; span > 1 {
+			interval := span / 10
+			if interval == 0 {
+				interval = 1
+			}
+			log.Infof("Narrow it down by re-exporting checkpoints with --from-block %d --to-block %d --checkpoint-interval %d on both sides",
+				h1.FromBlock, a.Block, interval)
+		}
+		return fmt.Errorf("checkpoints differ after block %d", agreed)
+	}
+
+	if compared == 0 {
+		return fmt.Errorf("the checkpoint files have no block in common")
+	}
+	log.Infof("comparecheckpoints summary: compared=%d checkpoints, all equal up to block %d", compared, agreed)
+	return nil
+}
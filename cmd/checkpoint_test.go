@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// testLogs returns one log in each of the given blocks.
+func testLogs(blocks ...uint64) []types.Log {
+	var logs []types.Log
+	for _, b := range blocks {
+		logs = append(logs, types.Log{BlockNumber: b, Data: []byte{byte(b)}})
+	}
+	return logs
+}
+
+func TestDigestLogs(t *testing.T) {
+	logs := testLogs(2, 2, 5, 9)
+	logs[1].Index = 1
+	whole, points := digestLogs(logDigest{}, logs, false)
+
+	var blocks []uint64
+	for _, p := range points {
+		blocks = append(blocks, p.block)
+	}
+	if want := []uint64{2, 5, 9}; !reflect.DeepEqual(blocks, want) {
+		t.Fatalf("points at blocks %v, want %v", blocks, want)
+	}
+	if whole.logs != 4 {
+		t.Errorf("digest counts %d logs, want 4", whole.logs)
+	}
+
+	// Digesting in windows chained on each other gives the same digest.
+	first, _ := digestLogs(logDigest{}, logs[:2], false)
+	if chained, _ := digestLogs(first, logs[2:], false); chained != whole {
+		t.Errorf("chained digest %x differs from whole digest %x", chained.hash, whole.hash)
+	}
+
+	tests := []struct {
+		block uint64
+		want  logDigest
+	}{
+		{block: 1, want: logDigest{}},
+		{block: 2, want: points[0].digest},
+		{block: 4, want: points[0].digest},
+		{block: 5, want: points[1].digest},
+		{block: 8, want: points[1].digest},
+		{block: 100, want: whole},
+	}
+	for _, tt := range tests {
+		if got := digestAt(logDigest{}, points, tt.block); got != tt.want {
+			t.Errorf("digestAt(%d) = %x, want %x", tt.block, got.hash, tt.want.hash)
+		}
+	}
+
+	if reordered, _ := digestLogs(logDigest{}, []types.Log{logs[1], logs[0], logs[2], logs[3]}, true); reordered != whole {
+		t.Error("with ignoreOrder the order of logs within a block changed the digest")
+	}
+}
+
+func TestCheckpointBisection(t *testing.T) {
+	var all []uint64
+	for b := uint64(1); b <= 40; b++ {
+		all = append(all, b)
+	}
+	tests := []struct {
+		name   string
+		logs2  []types.Log
+		want   uint64 // first differing block, 0 if none
+		agreed uint64
+	}{
+		{name: "equal", logs2: testLogs(all...), agreed: 40},
+		{name: "first block", logs2: testLogs(all[1:]...), want: 1},
+		{name: "differing log", logs2: func() []types.Log {
+			logs := testLogs(all...)
+			logs[16].Data = []byte{0xff}
+			return logs
+		}(), want: 17, agreed: 10},
+		{name: "missing log", logs2: testLogs(append(append([]uint64{}, all[:26]...), all[27:]...)...), want: 27, agreed: 20},
+		{name: "extra log", logs2: append(testLogs(all[:35]...), append(testLogs(35), testLogs(all[35:]...)...)...), want: 35, agreed: 30},
+	}
+	for _, tt := range tests {
+		lc := &logComparer{checkpointInterval: 10}
+		logs1 := testLogs(all...)
+		// Windows of 15 blocks, so that checkpoints fall inside and at the
+		// edge of windows and the bisection crosses window boundaries.
+		for start := uint64(1); start <= 40; start += 15 {
+			end := start + 14
+			if end > 40 {
+				end = 40
+			}
+			w := &logWindow{start: start, end: end}
+			base1, base2 := lc.digestsBefore(w)
+			w.digest1, w.points1 = digestLogs(base1, logsIn(logs1, start, end), false)
+			w.digest2, w.points2 = digestLogs(base2, logsIn(tt.logs2, start, end), false)
+			for b := (start + 9) / 10 * 10; b <= end; b += 10 {
+				if err := lc.checkpoint(b, w); err != nil {
+					t.Fatal(err)
+				}
+			}
+			lc.windows = append(lc.windows, w)
+		}
+		if lc.diverged != tt.want {
+			t.Errorf("%s: first differing block %d, want %d", tt.name, lc.diverged, tt.want)
+		}
+		if lc.agreedAt != tt.agreed {
+			t.Errorf("%s: last agreeing checkpoint %d, want %d", tt.name, lc.agreedAt, tt.agreed)
+		}
+	}
+}
+
+func logsIn(logs []types.Log, from, to uint64) []types.Log {
+	var res []types.Log
+	for _, l := range logs {
+		if from <= l.BlockNumber && l.BlockNumber <= to {
+			res = append(res, l)
+		}
+	}
+	return res
+}
@@ -4,9 +4,12 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math/big"
+	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,6 +17,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -27,42 +31,77 @@ const (
 	TopicsFlag        = "topics"
 	IgnoreOrderFlag   = "ignore-order"
 	TimeoutFlag       = "timeout"
+	ConfirmationsFlag = "confirmations"
+	FollowFlag        = "follow"
+	PollIntervalFlag  = "poll-interval"
+	VerifyFlag        = "verify"
+	AddressFileFlag   = "address-file"
+	MaxAddressesFlag  = "max-addresses"
+	BlockOffsetFlag   = "block-offset"
+
+	AllowDifferentGenesisFlag = "allow-different-genesis"
 )
 
 // MaxBlocksPerRequest is the maximum block span per FilterLogs call.
 // A value of 300 means we query [from..to] where to-from+1 <= 300.
 const MaxBlocksPerRequest uint64 = 300
 
+// maxReorgRetries bounds how many times the windows are recomputed in a row
+// when the chains keep reorganising underneath the comparison.
+const maxReorgRetries = 5
+
 var compareLogsCmd = &cobra.Command{
 	Use:   "comparelogs",
 	Short: "Fetch logs from two chains and compare if the results are the same",
 	Run: func(cmd *cobra.Command, args []string) {
 		chain1, _ := cmd.Flags().GetString(CompareChain1Flag)
 		chain2, _ := cmd.Flags().GetString(CompareChain2Flag)
+		snapshot, _ := cmd.Flags().GetString(SnapshotFlag)
 		fromBlock, _ := cmd.Flags().GetUint64(FromBlockFlag)
-		toBlock, _ := cmd.Flags().GetUint64(ToBlockFlag)
-		addrStr, _ := cmd.Flags().GetString(AddressFlag)
+		toBlockStr, _ := cmd.Flags().GetString(ToBlockFlag)
+		confirmations, _ := cmd.Flags().GetUint64(ConfirmationsFlag)
+		addrStrs, _ := cmd.Flags().GetStringSlice(AddressFlag)
+		addrFile, _ := cmd.Flags().GetString(AddressFileFlag)
+		maxAddresses, _ := cmd.Flags().GetInt(MaxAddressesFlag)
 		topicsRaw, _ := cmd.Flags().GetStringSlice(TopicsFlag)
 		ignoreOrder, _ := cmd.Flags().GetBool(IgnoreOrderFlag)
 		timeout, _ := cmd.Flags().GetDuration(TimeoutFlag)
+		follow, _ := cmd.Flags().GetBool(FollowFlag)
+		pollInterval, _ := cmd.Flags().GetDuration(PollIntervalFlag)
+		verifyStr, _ := cmd.Flags().GetString(VerifyFlag)
+		checkpointInterval, _ := cmd.Flags().GetUint64(CheckpointIntervalFlag)
+		checkpointFile1, _ := cmd.Flags().GetString(CheckpointFile1Flag)
+		checkpointFile2, _ := cmd.Flags().GetString(CheckpointFile2Flag)
+		blockOffset, _ := cmd.Flags().GetInt64(BlockOffsetFlag)
+		allowDifferentGenesis, _ := cmd.Flags().GetBool(AllowDifferentGenesisFlag)
+		metricsAddr, _ := cmd.Flags().GetString(MetricsAddrFlag)
 
-		if chain1 == "" || chain2 == "" {
-			log.Error("Both --chain-1 and --chain-2 are required")
+		if chain1 == "" {
+			log.Error("--chain-1 is required")
+			return
+		}
+		if (chain2 == "") == (snapshot == "") {
+			log.Error("Exactly one of --chain-2 and --snapshot is required")
 			return
 		}
 		if fromBlock == 0 {
 			log.Error("--from-block is required (must be > 0)")
 			return
 		}
-		if toBlock != 0 && toBlock < fromBlock {
-			log.Errorf("--to-block (%d) < --from-block (%d)", toBlock, fromBlock)
+		toBlock, err := parseBlockSpec(toBlockStr)
+		if err != nil {
+			log.WithError(err).Error("Invalid --to-block")
+			return
+		}
+		if !toBlock.isTag() && toBlock.number < fromBlock {
+			log.Errorf("--to-block (%d) < --from-block (%d)", toBlock.number, fromBlock)
 			return
 		}
 
-		var addr *common.Address
-		if strings.TrimSpace(addrStr) != "" {
-			a := common.HexToAddress(addrStr)
-			addr = &a
+		addresses, err := loadAddresses(addrStrs, addrFile)
+		if err != nil {
+			log.WithError(err).Error("Invalid --address/--address-file")
+			return
 		}
 
 		topics, err := parseTopics(topicsRaw)
@@ -71,11 +110,70 @@ var compareLogsCmd = &cobra.Command{
 			return
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		verify, err := parseVerifyMode(verifyStr)
+		if err != nil {
+			log.WithError(err).Error("Invalid --verify")
+			return
+		}
+
+		if follow && !toBlock.isTag() {
+			log.Error("--follow requires --to-block latest|finalized|safe")
+			return
+		}
+		if (checkpointFile1 != "" || checkpointFile2 != "") && checkpointInterval == 0 {
+			log.Error("--checkpoint-file-1/--checkpoint-file-2 require --checkpoint-interval")
+			return
+		}
+		if follow && snapshot != "" {
+			log.Error("--follow cannot be used with --snapshot")
+			return
+		}
+		if follow && pollInterval <= 0 {
+			log.Error("--poll-interval must be > 0")
+			return
+		}
+		if metricsAddr != "" && !follow {
+			log.Error("--metrics-addr requires --follow")
+			return
+		}
+		if err := startMetrics(metricsAddr); err != nil {
+			log.WithError(err).Error("Failed to start the metrics server")
+			return
+		}
+
+		// A follow run has no natural end, so the overall timeout only
+		// applies to one-shot comparisons.
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+		)
+		if follow {
+			ctx, cancel = context.WithCancel(cmd.Context())
+		} else {
+			ctx, cancel = context.WithTimeout(cmd.Context(), timeout)
+		}
 		defer cancel()
 
-		err = doCompareLogs(ctx, chain1, chain2, fromBlock, toBlock, addr, topics, ignoreOrder)
-		if err != nil {
+		err = doCompareLogs(ctx, chain1, chain2, compareLogsOptions{
+			snapshot:              snapshot,
+			fromBlock:             fromBlock,
+			toBlock:               toBlock,
+			confirmations:         confirmations,
+			addresses:             addresses,
+			maxAddresses:          maxAddresses,
+			topics:                topics,
+			ignoreOrder:           ignoreOrder,
+			verify:                verify,
+			blockOffset:           blockOffset,
+			allowDifferentGenesis: allowDifferentGenesis,
+			follow:                follow,
+			pollInterval:          pollInterval,
+
+			checkpointInterval: checkpointInterval,
+			checkpointFile1:    checkpointFile1,
+			checkpointFile2:    checkpointFile2,
+		})
+		if err != nil && !(follow && stopped(cmd)) {
 			log.WithError(err).Error("comparelogs failed")
 			return
 		}
@@ -85,139 +183,1073 @@ var compareLogsCmd = &cobra.Command{
 func init() {
 	compareLogsCmd.Flags().String(CompareChain1Flag, "", "RPC endpoint for chain 1")
 	compareLogsCmd.Flags().String(CompareChain2Flag, "", "RPC endpoint for chain 2")
+	compareLogsCmd.Flags().String(SnapshotFlag, "", "Snapshot file written by exportlogs to compare chain 1 against, instead of --chain-2")
 	compareLogsCmd.Flags().Uint64(FromBlockFlag, 0, "Start block (inclusive)")
-	compareLogsCmd.Flags().Uint64(ToBlockFlag, 0, "End block (inclusive). 0 means latest on each chain")
-	compareLogsCmd.Flags().String(AddressFlag, "", "Contract address to filter (optional)")
+	compareLogsCmd.Flags().String(ToBlockFlag, "0", "End block (inclusive): a block number or latest|finalized|safe. 0 means latest on each chain")
+	compareLogsCmd.Flags().Uint64(ConfirmationsFlag, 0, "Stay this many blocks behind the latest/finalized/safe head of each chain")
+	compareLogsCmd.Flags().StringSlice(AddressFlag, nil, "Contract address to filter (optional, repeatable)")
+	compareLogsCmd.Flags().String(AddressFileFlag, "", "File with contract addresses to filter: a JSON array or one address per line")
+	compareLogsCmd.Flags().Int(MaxAddressesFlag, 1000, "Maximum number of addresses per FilterLogs call. 0 means no limit")
 	compareLogsCmd.Flags().StringSlice(TopicsFlag, nil, "Topics to filter. Each item is a comma-separated list of topic hashes for that position (OR). Example: --topics 0xddf...,0xabc... --topics 0x123...")
 	compareLogsCmd.Flags().Bool(IgnoreOrderFlag, true, "Ignore log ordering differences")
-	compareLogsCmd.Flags().Duration(TimeoutFlag, 30*time.Second, "Overall timeout")
+	compareLogsCmd.Flags().Duration(TimeoutFlag, 30*time.Second, "Overall timeout (ignored with --follow)")
+	compareLogsCmd.Flags().Int64(BlockOffsetFlag, 0, "Block numbering shift of chain 2: block N on chain 1 is compared with block N+offset on chain 2")
+	compareLogsCmd.Flags().Bool(AllowDifferentGenesisFlag, false, "Compare chains with different genesis hashes (block hashes are then left out of the comparison)")
+	compareLogsCmd.Flags().String(VerifyFlag, "", "Check each chain's logs against its own headers: bloom (logsBloom), or receipts (also rebuild the receipts trie from eth_getBlockReceipts; slow)")
+	compareLogsCmd.Flags().Uint64(CheckpointIntervalFlag, 0, "Compare rolling log digests every N blocks and bisect to the first differing block. 0 disables checkpoints")
+	compareLogsCmd.Flags().String(CheckpointFile1Flag, "", "Write the checkpoints of chain 1 to this file (see comparecheckpoints)")
+	compareLogsCmd.Flags().String(CheckpointFile2Flag, "", "Write the checkpoints of chain 2 to this file (see comparecheckpoints)")
+	compareLogsCmd.Flags().Bool(FollowFlag, false, "Keep comparing new blocks as both chains advance")
+	compareLogsCmd.Flags().Duration(PollIntervalFlag, 5*time.Second, "How often to check the chain heads with --follow")
+	compareLogsCmd.Flags().String(MetricsAddrFlag, "", "Serve Prometheus metrics on this address with --follow, e.g. :9100 (disabled if empty)")
 
 	_ = compareLogsCmd.MarkFlagRequired(CompareChain1Flag)
-	_ = compareLogsCmd.MarkFlagRequired(CompareChain2Flag)
 	_ = compareLogsCmd.MarkFlagRequired(FromBlockFlag)
 
 	rootCmd.AddCommand(compareLogsCmd)
 }
 
-func doCompareLogs(ctx context.Context, chain1, chain2 string, fromBlock, toBlock uint64, addr *common.Address, topics [][]common.Hash, ignoreOrder bool) error {
+// compareLogsOptions holds everything doCompareLogs needs besides the two
+// endpoints.
+type compareLogsOptions struct {
+	// snapshot is a file written by exportlogs that takes the place of
+	// chain 2 when set.
+	snapshot string
+
+	fromBlock     uint64
+	toBlock       blockSpec
+	confirmations uint64
+	addresses     []common.Address
+	maxAddresses  int
+	topics        [][]common.Hash
+	ignoreOrder   bool
+	verify        string
+
+	// blockOffset shifts the block numbers of chain 2 against chain 1.
+	// Chains with different genesis hashes are refused unless
+	// allowDifferentGenesis is set.
+	blockOffset           int64
+	allowDifferentGenesis bool
+
+	// follow keeps comparing new blocks after catching up, checking both
+	// chains every pollInterval or whenever one of them announces a new head.
+	follow       bool
+	pollInterval time.Duration
+
+	// checkpointInterval enables rolling digests checked every that many
+	// blocks. The checkpoint files, if set, receive each chain's digests.
+	checkpointInterval uint64
+	checkpointFile1    string
+	checkpointFile2    string
+}
+
+func doCompareLogs(ctx context.Context, chain1, chain2 string, opts compareLogsOptions) error {
 	c1, err := ethclient.DialContext(ctx, chain1)
 	if err != nil {
 		return fmt.Errorf("dial chain1: %w", err)
 	}
 	defer c1.Close()
 
-	c2, err := ethclient.DialContext(ctx, chain2)
-	if err != nil {
-		return fmt.Errorf("dial chain2: %w", err)
+	lc := &logComparer{
+		c1:           c1,
+		addresses:    opts.addresses,
+		maxAddresses: opts.maxAddresses,
+		topics:       opts.topics,
+		ignoreOrder:  opts.ignoreOrder,
+		verify:       opts.verify,
+		blockOffset:  opts.blockOffset,
 	}
-	defer c2.Close()
 
-	to1 := toBlock
-	to2 := toBlock
-	if toBlock == 0 {
-		b1, err := c1.BlockNumber(ctx)
+	if opts.snapshot != "" {
+		snap, err := loadLogSnapshot(opts.snapshot)
+		if err != nil {
+			return fmt.Errorf("load snapshot: %w", err)
+		}
+		h := snap.header
+		log.Infof("Comparing chain1 against snapshot %s: chainId=%s blocks=%d..%d logs=%d", opts.snapshot, h.ChainID, h.FromBlock, h.ToBlock, len(snap.logs))
+		if from2 := int64(opts.fromBlock) + opts.blockOffset; from2 < int64(h.FromBlock) {
+			if opts.blockOffset == 0 {
+				return fmt.Errorf("from-block (%d) is before the start of the snapshot (%d)", opts.fromBlock, h.FromBlock)
+			}
+			return fmt.Errorf("from-block (%d, %d with block offset %d) is before the start of the snapshot (%d)", opts.fromBlock, from2, opts.blockOffset, h.FromBlock)
+		}
+		// Without a filter of its own the comparison uses the one the
+		// snapshot was recorded with; anything broader would only find logs
+		// the snapshot never contained.
+		if len(lc.addresses) == 0 && len(lc.topics) == 0 {
+			lc.addresses, lc.topics = h.Addresses, h.Topics
+		} else if len(h.Addresses) > 0 || len(h.Topics) > 0 {
+			log.Warn("Comparing with a different filter than the snapshot was recorded with; logs outside the snapshot filter will show up as mismatches")
+		}
+		lc.snap = snap
+	} else {
+		c2, err := ethclient.DialContext(ctx, chain2)
 		if err != nil {
-			return fmt.Errorf("chain1 latest block: %w", err)
+			return fmt.Errorf("dial chain2: %w", err)
 		}
-		b2, err := c2.BlockNumber(ctx)
+		defer c2.Close()
+		lc.c2 = c2
+	}
+
+	if err := lc.preflight(ctx, opts.allowDifferentGenesis); err != nil {
+		return err
+	}
+	if int64(opts.fromBlock)+opts.blockOffset < 0 {
+		return fmt.Errorf("from-block (%d) with block offset %d is before the genesis of chain2", opts.fromBlock, opts.blockOffset)
+	}
+
+	end, err := lc.target(ctx, opts.toBlock, opts.confirmations)
+	if err != nil {
+		return err
+	}
+
+	if opts.checkpointInterval > 0 {
+		closeCheckpoints, err := lc.openCheckpoints(ctx, opts)
 		if err != nil {
-			return fmt.Errorf("chain2 latest block: %w", err)
+			return err
 		}
-		to1, to2 = b1, b2
-		if to1 != to2 {
-			log.Warnf("Chains latest blocks differ: chain1=%d chain2=%d; comparing each chain against its own latest", to1, to2)
+		defer closeCheckpoints()
+	}
+
+	if opts.follow {
+		err = lc.follow(ctx, opts.fromBlock, opts.toBlock, opts.confirmations, opts.pollInterval)
+		if sumErr := lc.summary(); err == nil {
+			err = sumErr
 		}
+		return err
 	}
 
-	if fromBlock > to1 || fromBlock > to2 {
-		return fmt.Errorf("from-block (%d) is greater than chain latest (chain1=%d chain2=%d)", fromBlock, to1, to2)
+	if opts.fromBlock > end {
+		return fmt.Errorf("from-block (%d) is greater than chain latest (%d)", opts.fromBlock, end)
+	}
+	if err := lc.compareRange(ctx, opts.fromBlock, end); err != nil {
+		return err
+	}
+	if lc.checkpointInterval > 0 && !isCheckpoint(end, lc.checkpointInterval) {
+		if err := lc.checkpoint(end, nil); err != nil {
+			return err
+		}
 	}
+	return lc.summary()
+}
+
+// logWindow is one FilterLogs span that has been compared, together with the
+// hash of its last block on each chain at the time the logs were fetched.
+type logWindow struct {
+	start, end   uint64
+	hash1, hash2 common.Hash
+	logs1, logs2 int
+	equal        bool
+
+	// invalid1 and invalid2 count the logs --verify found inconsistent with
+	// the endpoint's own headers, anomalies1 and anomalies2 the removed,
+	// duplicate, misordered or non-canonical logs checkLogs found.
+	invalid1, invalid2     int
+	anomalies1, anomalies2 int
+
+	// byAddress holds the per-contract results when several addresses are
+	// compared. Contracts without logs on either chain are left out.
+	byAddress map[common.Address]*addressResult
 
-	end := to1
-	if to2 < end {
-		end = to2
+	// digest1 and digest2 are the rolling digests at the end of the window,
+	// points1 and points2 the digests after each of its blocks with logs.
+	// Only filled in with --checkpoint-interval; the points are released
+	// once a later checkpoint agrees.
+	digest1, digest2 logDigest
+	points1, points2 []digestPoint
+
+	// countedAnomalies and countedMismatch are what the window added to the
+	// metrics, so that a window recomputed after a reorg only adds the
+	// difference.
+	countedAnomalies int64
+	countedMismatch  bool
+}
+
+// addressResult is the outcome of one window for a single contract.
+type addressResult struct {
+	logs1, logs2 int
+	equal        bool
+}
+
+// logTotals adds up the results of compared windows.
+type logTotals struct {
+	ok, mismatch           uint64
+	logs1, logs2           uint64
+	invalid1, invalid2     uint64
+	anomalies1, anomalies2 uint64
+	byAddress              map[common.Address]*addressTotals
+}
+
+// addressTotals adds up the results of compared windows for one contract.
+type addressTotals struct {
+	logs1, logs2 int
+	mismatch     int
+}
+
+func (t *logTotals) add(w *logWindow) {
+	if w.equal {
+		t.ok++
+	} else {
+		t.mismatch++
+	}
+	t.logs1 += uint64(w.logs1)
+	t.logs2 += uint64(w.logs2)
+	t.invalid1 += uint64(w.invalid1)
+	t.invalid2 += uint64(w.invalid2)
+	t.anomalies1 += uint64(w.anomalies1)
+	t.anomalies2 += uint64(w.anomalies2)
+	for addr, r := range w.byAddress {
+		if t.byAddress == nil {
+			t.byAddress = make(map[common.Address]*addressTotals)
+		}
+		a := t.byAddress[addr]
+		if a == nil {
+			a = &addressTotals{}
+			t.byAddress[addr] = a
+		}
+		a.logs1 += r.logs1
+		a.logs2 += r.logs2
+		if !r.equal {
+			a.mismatch++
+		}
 	}
+}
 
-	var (
-		totalRanges     uint64
-		mismatchRanges  uint64
-		okRanges        uint64
-		totalLogsChain1 uint64
-		totalLogsChain2 uint64
-	)
+// logComparer compares the logs of two chains window by window and keeps the
+// recent windows around so that they can be recomputed after a reorg. Older
+// windows are folded into pruned.
+// When snap is set it stands in for chain 2 and c2 is nil.
+//
+// Windows and everything reported are numbered as on chain 1; chain 2 is
+// queried at the same heights shifted by blockOffset.
+type logComparer struct {
+	c1, c2       *ethclient.Client
+	snap         *logSnapshot
+	addresses    []common.Address
+	maxAddresses int
+	topics       [][]common.Hash
+	ignoreOrder  bool
+	verify       string
+
+	blockOffset int64
+	// ignoreBlockHash leaves block hashes out of the comparison, as they
+	// cannot match between chains with different genesis or numbering.
+	ignoreBlockHash bool
+
+	checkpointInterval uint64
+	cp1, cp2           *checkpointWriter
+	// agreedAt is the last block at which both digests were known to be
+	// equal and diverged the first block at which they differ, 0 if none.
+	agreedAt uint64
+	diverged uint64
+
+	windows []*logWindow
+	// pruned adds up the windows dropped from windows, and base1 and base2
+	// are the rolling digests at the end of the last of them.
+	pruned       logTotals
+	base1, base2 logDigest
+}
 
-	for start := fromBlock; start <= end; {
+// compareRange compares [from..to] in windows of MaxBlocksPerRequest blocks.
+func (lc *logComparer) compareRange(ctx context.Context, from, to uint64) error {
+	for start := from; start <= to; {
 		windowEnd := start + MaxBlocksPerRequest - 1
-		if windowEnd > end {
-			windowEnd = end
+		if windowEnd > to {
+			windowEnd = to
 		}
-		totalRanges++
 
-		q1 := ethereum.FilterQuery{FromBlock: uint64ToBig(start), ToBlock: uint64ToBig(windowEnd), Topics: topics}
-		q2 := ethereum.FilterQuery{FromBlock: uint64ToBig(start), ToBlock: uint64ToBig(windowEnd), Topics: topics}
-		if addr != nil {
-			q1.Addresses = []common.Address{*addr}
-			q2.Addresses = []common.Address{*addr}
+		w := &logWindow{start: start, end: windowEnd}
+		if err := lc.compareWindow(ctx, w); err != nil {
+			return err
 		}
+		lc.windows = append(lc.windows, w)
+		if err := lc.checkReorg(ctx); err != nil {
+			return err
+		}
+		lc.prune()
+
+		if windowEnd == to {
+			break
+		}
+		start = windowEnd + 1
+	}
+	return nil
+}
+
+func (lc *logComparer) compareWindow(ctx context.Context, w *logWindow) error {
+	start, windowEnd := w.start, w.end
+
+	h1, h2, err := lc.blockHashes(ctx, windowEnd)
+	if err != nil {
+		return err
+	}
+
+	logs1, err := filterLogsChunked(ctx, lc.c1, start, windowEnd, lc.addresses, lc.maxAddresses, lc.topics)
+	if err != nil {
+		return fmt.Errorf("chain1 FilterLogs [%d..%d]: %w", start, windowEnd, err)
+	}
+	start2, end2 := lc.chain2Block(start), lc.chain2Block(windowEnd)
+	var logs2 []types.Log
+	if lc.snap != nil {
+		logs2 = lc.snap.FilterLogs(ethereum.FilterQuery{FromBlock: uint64ToBig(start2), ToBlock: uint64ToBig(end2), Addresses: lc.addresses, Topics: lc.topics})
+	} else if logs2, err = filterLogsChunked(ctx, lc.c2, start2, end2, lc.addresses, lc.maxAddresses, lc.topics); err != nil {
+		return fmt.Errorf("chain2 FilterLogs [%d..%d]: %w", start2, end2, err)
+	}
+
+	if w.anomalies1, err = checkLogs(ctx, "chain1", lc.c1, logs1); err != nil {
+		return err
+	}
+	if w.anomalies2, err = checkLogs(ctx, "chain2", lc.c2, logs2); err != nil {
+		return err
+	}
+	if lc.verify != verifyNone {
+		if w.invalid1, err = lc.verifyLogs(ctx, "chain1", lc.c1, start, windowEnd, logs1); err != nil {
+			return err
+		}
+		if lc.c2 != nil {
+			if w.invalid2, err = lc.verifyLogs(ctx, "chain2", lc.c2, start2, end2, logs2); err != nil {
+				return err
+			}
+		}
+	}
+
+	logs1, logs2 = lc.normalize(logs1, false), lc.normalize(logs2, true)
+
+	s1 := canonicalizeLogs(logs1, lc.ignoreOrder)
+	s2 := canonicalizeLogs(logs2, lc.ignoreOrder)
+
+	sum1 := sha256.Sum256([]byte(strings.Join(s1, "\n")))
+	sum2 := sha256.Sum256([]byte(strings.Join(s2, "\n")))
+
+	w.logs1, w.logs2 = len(logs1), len(logs2)
+	w.equal = sum1 == sum2
+	if len(lc.addresses) > 1 {
+		w.byAddress = lc.compareByAddress(w, logs1, logs2)
+	}
+	if lc.checkpointInterval > 0 {
+		base1, base2 := lc.digestsBefore(w)
+		w.digest1, w.points1 = digestLogs(base1, logs1, lc.ignoreOrder)
+		w.digest2, w.points2 = digestLogs(base2, logs2, lc.ignoreOrder)
+		first := (start + lc.checkpointInterval - 1) / lc.checkpointInterval * lc.checkpointInterval
+		for b := first; b <= windowEnd; b += lc.checkpointInterval {
+			if err := lc.checkpoint(b, w); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Only now is the window complete, so checkReorg recomputes a window
+	// whose recomputation failed halfway.
+	w.hash1, w.hash2 = h1, h2
+
+	gaugeMetric(compareBlockMetric).Update(int64(windowEnd))
+	anomalies := int64(w.anomalies1 + w.anomalies2 + w.invalid1 + w.invalid2)
+	counterMetric(compareAnomaliesMetric).Inc(anomalies - w.countedAnomalies)
+	switch {
+	case !w.equal && !w.countedMismatch:
+		counterMetric(compareMismatchMetric).Inc(1)
+	case w.equal && w.countedMismatch:
+		counterMetric(compareMismatchMetric).Dec(1)
+	}
+	w.countedAnomalies, w.countedMismatch = anomalies, !w.equal
+	if !w.equal {
+		log.Errorf("[range %d..%d] Logs differ (sha256 chain1=%s chain2=%s) count(chain1)=%d count(chain2)=%d",
+			start, windowEnd, hex.EncodeToString(sum1[:]), hex.EncodeToString(sum2[:]), len(s1), len(s2))
+
+		// show small diff info (best-effort)
+		min := len(s1)
+		if len(s2) < min {
+			min = len(s2)
+		}
+		idx := -1
+		for i := 0; i < min; i++ {
+			if s1[i] != s2[i] {
+				idx = i
+				break
+			}
+		}
+		if idx != -1 {
+			log.Errorf("[range %d..%d] First mismatch at index %d:\nchain1: %s\nchain2: %s", start, windowEnd, idx, s1[idx], s2[idx])
+		} else if len(s1) != len(s2) {
+			log.Errorf("[range %d..%d] Log count differs: chain1=%d chain2=%d", start, windowEnd, len(s1), len(s2))
+		}
+	} else {
+		log.Infof("[range %d..%d] Logs equal. count=%d sha256=%s", start, windowEnd, len(s1), hex.EncodeToString(sum1[:]))
+	}
+	return nil
+}
 
-		logs1, err := c1.FilterLogs(ctx, q1)
+// filterLogsChunked fetches the logs of [from..to] from c, splitting the
+// address filter into chunks of at most maxAddresses per call.
+func filterLogsChunked(ctx context.Context, c *ethclient.Client, from, to uint64, addresses []common.Address, maxAddresses int, topics [][]common.Hash) ([]types.Log, error) {
+	q := ethereum.FilterQuery{FromBlock: uint64ToBig(from), ToBlock: uint64ToBig(to), Topics: topics}
+	if maxAddresses <= 0 || len(addresses) <= maxAddresses {
+		q.Addresses = addresses
+		return c.FilterLogs(ctx, q)
+	}
+
+	var chunks [][]types.Log
+	for i := 0; i < len(addresses); i += maxAddresses {
+		j := i + maxAddresses
+		if j > len(addresses) {
+			j = len(addresses)
+		}
+		q.Addresses = addresses[i:j]
+		chunk, err := c.FilterLogs(ctx, q)
 		if err != nil {
-			return fmt.Errorf("chain1 FilterLogs [%d..%d]: %w", start, windowEnd, err)
+			return nil, fmt.Errorf("addresses %d..%d: %w", i, j-1, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return mergeLogChunks(chunks), nil
+}
+
+// mergeLogChunks merges the answers of several FilterLogs calls into the
+// order a single call would have returned, by block and log index. Each
+// chunk keeps the order the node returned it in, so that checkLogs still
+// sees a misordered answer: the merge only interleaves chunks and never
+// sorts within one.
+func mergeLogChunks(chunks [][]types.Log) []types.Log {
+	var n int
+	for _, chunk := range chunks {
+		n += len(chunk)
+	}
+	logs := make([]types.Log, 0, n)
+	for len(logs) < n {
+		next := -1
+		for i, chunk := range chunks {
+			if len(chunk) == 0 {
+				continue
+			}
+			if next < 0 || chunk[0].BlockNumber < chunks[next][0].BlockNumber ||
+				(chunk[0].BlockNumber == chunks[next][0].BlockNumber && chunk[0].Index < chunks[next][0].Index) {
+				next = i
+			}
+		}
+		logs = append(logs, chunks[next][0])
+		chunks[next] = chunks[next][1:]
+	}
+	return logs
+}
+
+// compareByAddress splits the logs of a window per contract and compares
+// each contract on its own, logging the contracts that differ.
+func (lc *logComparer) compareByAddress(w *logWindow, logs1, logs2 []types.Log) map[common.Address]*addressResult {
+	group := func(logs []types.Log) map[common.Address][]types.Log {
+		m := make(map[common.Address][]types.Log)
+		for _, l := range logs {
+			m[l.Address] = append(m[l.Address], l)
+		}
+		return m
+	}
+	g1, g2 := group(logs1), group(logs2)
+
+	res := make(map[common.Address]*addressResult)
+	for _, addr := range lc.addresses {
+		l1, l2 := g1[addr], g2[addr]
+		if len(l1) == 0 && len(l2) == 0 {
+			continue
+		}
+		s1 := strings.Join(canonicalizeLogs(l1, lc.ignoreOrder), "\n")
+		s2 := strings.Join(canonicalizeLogs(l2, lc.ignoreOrder), "\n")
+		r := &addressResult{logs1: len(l1), logs2: len(l2), equal: s1 == s2}
+		if !r.equal {
+			log.Errorf("[range %d..%d] Logs of %s differ: count(chain1)=%d count(chain2)=%d", w.start, w.end, addr.Hex(), r.logs1, r.logs2)
+		}
+		res[addr] = r
+	}
+	return res
+}
+
+// target resolves toBlock on both chains and returns the highest block both
+// of them have reached.
+func (lc *logComparer) target(ctx context.Context, toBlock blockSpec, confirmations uint64) (uint64, error) {
+	to1, err := toBlock.resolve(ctx, lc.c1, confirmations)
+	if err != nil {
+		return 0, fmt.Errorf("chain1 %s block: %w", toBlock, err)
+	}
+	var to2 uint64
+	if lc.snap != nil {
+		to2 = lc.snap.header.ToBlock
+	} else {
+		spec := toBlock
+		if !spec.isTag() {
+			spec.number = lc.chain2Block(spec.number)
+		}
+		if to2, err = spec.resolve(ctx, lc.c2, confirmations); err != nil {
+			return 0, fmt.Errorf("chain2 %s block: %w", spec, err)
+		}
+	}
+	// Continue in chain 1 numbering.
+	if shifted := int64(to2) - lc.blockOffset; shifted < 0 {
+		to2 = 0
+	} else {
+		to2 = uint64(shifted)
+	}
+	if toBlock.isTag() && lc.snap == nil {
+		log.Debugf("Resolved --to-block %s (confirmations=%d): chain1=%d chain2=%d", toBlock, confirmations, to1, to2)
+		if to1 != to2 {
+			log.Warnf("Chains %s blocks differ: chain1=%d chain2=%d; comparing up to the lower one", toBlock, to1, to2)
 		}
-		logs2, err := c2.FilterLogs(ctx, q2)
+	}
+	if to2 < to1 {
+		return to2, nil
+	}
+	return to1, nil
+}
+
+// follow compares everything from next onwards and then keeps going as both
+// chains advance. Blocks are only compared once both chains have passed
+// them, so a lagging chain simply holds the comparison back. A failed
+// comparison is retried on the next tick. It returns when ctx is done.
+func (lc *logComparer) follow(ctx context.Context, next uint64, toBlock blockSpec, confirmations uint64, interval time.Duration) error {
+	wake := make(chan struct{}, 1)
+	lc.watchHeads(ctx, lc.c1, "chain1", wake)
+	lc.watchHeads(ctx, lc.c2, "chain2", wake)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		end, err := lc.target(ctx, toBlock, confirmations)
 		if err != nil {
-			return fmt.Errorf("chain2 FilterLogs [%d..%d]: %w", start, windowEnd, err)
+			log.WithError(err).Warn("Failed to read chain heads, retrying")
+		} else if end >= next {
+			if err := lc.compareRange(ctx, next, end); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.WithError(err).Warnf("Failed to compare blocks %d..%d, retrying", next, end)
+			}
+			// Resume after the last window compared, even if a later one failed.
+			if n := len(lc.windows); n > 0 && lc.windows[n-1].end >= next {
+				next = lc.windows[n-1].end + 1
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// watchHeads subscribes to new heads on c and signals wake on each of them.
+// Endpoints without subscription support (plain HTTP) are left to polling.
+func (lc *logComparer) watchHeads(ctx context.Context, c *ethclient.Client, name string, wake chan<- struct{}) {
+	headers := make(chan *types.Header)
+	sub, err := c.SubscribeNewHead(ctx, headers)
+	if err != nil {
+		log.Debugf("%s does not support head subscriptions, polling instead: %v", name, err)
+		return
+	}
+	go func() {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-sub.Err():
+				log.Warnf("%s head subscription dropped, polling instead: %v", name, err)
+				return
+			case <-headers:
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+}
+
+// chain2Block maps a block number of chain 1 to the same block on chain 2.
+func (lc *logComparer) chain2Block(number uint64) uint64 {
+	return uint64(int64(number) + lc.blockOffset)
+}
+
+// normalize prepares logs for the comparison: logs of chain 2 are moved to
+// chain 1 numbering and block hashes are cleared when they cannot match.
+func (lc *logComparer) normalize(logs []types.Log, chain2 bool) []types.Log {
+	shift := chain2 && lc.blockOffset != 0
+	if !shift && !lc.ignoreBlockHash {
+		return logs
+	}
+	out := make([]types.Log, len(logs))
+	for i, l := range logs {
+		if shift {
+			l.BlockNumber = uint64(int64(l.BlockNumber) - lc.blockOffset)
 		}
+		if lc.ignoreBlockHash {
+			l.BlockHash = common.Hash{}
+		}
+		out[i] = l
+	}
+	return out
+}
+
+// chainInfo identifies the network behind an endpoint.
+type chainInfo struct {
+	chainID   *big.Int
+	networkID *big.Int
+	genesis   common.Hash
+	head      uint64
+}
+
+func fetchChainInfo(ctx context.Context, c *ethclient.Client) (chainInfo, error) {
+	var (
+		info chainInfo
+		err  error
+	)
+	if info.chainID, info.genesis, err = chainIdentity(ctx, c); err != nil {
+		return info, err
+	}
+	// Many providers do not serve net_version, and chain id and genesis
+	// identify the chain without it.
+	if info.networkID, err = c.NetworkID(ctx); err != nil {
+		log.Warnf("Failed to get the network id, comparing chain id and genesis only: %s", err)
+	}
+	if info.head, err = c.BlockNumber(ctx); err != nil {
+		return info, fmt.Errorf("latest block: %w", err)
+	}
+	return info, nil
+}
 
-		totalLogsChain1 += uint64(len(logs1))
-		totalLogsChain2 += uint64(len(logs2))
+// preflight prints the identity of both chains and refuses to compare chains
+// with different genesis hashes unless allowDifferentGenesis is set.
+func (lc *logComparer) preflight(ctx context.Context, allowDifferentGenesis bool) error {
+	info1, err := fetchChainInfo(ctx, lc.c1)
+	if err != nil {
+		return fmt.Errorf("chain1 identity: %w", err)
+	}
+	log.Infof("chain1: chainId=%s networkId=%s genesis=%s head=%d", info1.chainID, info1.networkID, info1.genesis.Hex(), info1.head)
+
+	var info2 chainInfo
+	if lc.snap != nil {
+		h := lc.snap.header
+		info2 = chainInfo{chainID: h.ChainID, genesis: h.GenesisHash, head: h.ToBlock}
+		log.Infof("chain2 (snapshot): chainId=%s genesis=%s toBlock=%d", info2.chainID, info2.genesis.Hex(), info2.head)
+	} else {
+		if info2, err = fetchChainInfo(ctx, lc.c2); err != nil {
+			return fmt.Errorf("chain2 identity: %w", err)
+		}
+		log.Infof("chain2: chainId=%s networkId=%s genesis=%s head=%d", info2.chainID, info2.networkID, info2.genesis.Hex(), info2.head)
+	}
 
-		s1 := canonicalizeLogs(logs1, ignoreOrder)
-		s2 := canonicalizeLogs(logs2, ignoreOrder)
+	if info1.chainID != nil && info2.chainID != nil && info1.chainID.Cmp(info2.chainID) != 0 {
+		log.Warnf("Chain ids differ: chain1=%s chain2=%s", info1.chainID, info2.chainID)
+	}
+	if info1.networkID != nil && info2.networkID != nil && info1.networkID.Cmp(info2.networkID) != 0 {
+		log.Warnf("Network ids differ: chain1=%s chain2=%s", info1.networkID, info2.networkID)
+	}
+	if lc.blockOffset != 0 {
+		log.Infof("Block offset %d: block N on chain1 is compared with block N%+d on chain2", lc.blockOffset, lc.blockOffset)
+		lc.ignoreBlockHash = true
+	}
+	if info1.genesis != info2.genesis {
+		if !allowDifferentGenesis {
+			return fmt.Errorf("chains have different genesis hashes (chain1=%s chain2=%s), pass --%s to compare them anyway",
+				info1.genesis.Hex(), info2.genesis.Hex(), AllowDifferentGenesisFlag)
+		}
+		log.Warnf("Genesis hashes differ: chain1=%s chain2=%s; block hashes are left out of the comparison", info1.genesis.Hex(), info2.genesis.Hex())
+		lc.ignoreBlockHash = true
+	}
+	return nil
+}
 
-		h1 := sha256.Sum256([]byte(strings.Join(s1, "\n")))
-		h2 := sha256.Sum256([]byte(strings.Join(s2, "\n")))
+// blockHashes returns the hash of the given block on both chains.
+func (lc *logComparer) blockHashes(ctx context.Context, number uint64) (common.Hash, common.Hash, error) {
+	h1, err := lc.c1.HeaderByNumber(ctx, uint64ToBig(number))
+	if err != nil {
+		return common.Hash{}, common.Hash{}, fmt.Errorf("chain1 header %d: %w", number, err)
+	}
+	if lc.c2 == nil {
+		// A snapshot never reorgs.
+		return h1.Hash(), common.Hash{}, nil
+	}
+	h2, err := lc.c2.HeaderByNumber(ctx, uint64ToBig(lc.chain2Block(number)))
+	if err != nil {
+		return common.Hash{}, common.Hash{}, fmt.Errorf("chain2 header %d: %w", lc.chain2Block(number), err)
+	}
+	return h1.Hash(), h2.Hash(), nil
+}
 
-		if h1 != h2 {
-			mismatchRanges++
-			log.Errorf("[range %d..%d] Logs differ (sha256 chain1=%s chain2=%s) count(chain1)=%d count(chain2)=%d",
-				start, windowEnd, hex.EncodeToString(h1[:]), hex.EncodeToString(h2[:]), len(s1), len(s2))
+// prune drops the windows that end more than reorgWindow blocks before the
+// newest one, so that following a chain for days does not keep every window
+// around. Reorgs deeper than that are not rechecked. With checkpoints, the
+// windows after the last agreeing checkpoint are kept until the first
+// differing block is known, as the bisection needs their digests.
+func (lc *logComparer) prune() {
+	last := lc.windows[len(lc.windows)-1].end
+	n := 0
+	for _, w := range lc.windows[:len(lc.windows)-1] {
+		if w.end+reorgWindow > last || (lc.checkpointInterval > 0 && lc.diverged == 0 && w.end > lc.agreedAt) {
+			break
+		}
+		lc.pruned.add(w)
+		lc.base1, lc.base2 = w.digest1, w.digest2
+		n++
+	}
+	if n > 0 {
+		lc.windows = append(lc.windows[:0], lc.windows[n:]...)
+	}
+}
 
-			// show small diff info (best-effort)
-			min := len(s1)
-			if len(s2) < min {
-				min = len(s2)
+// checkReorg re-reads the last block hash of the compared windows, newest
+// first, and recomputes every window whose hash changed on either chain.
+// Blocks are hash-linked, so the walk stops at the first intact window
+// before the newest one: every older window was intact at the previous
+// check, while the newest one was only just compared, after any reorg of
+// the others.
+func (lc *logComparer) checkReorg(ctx context.Context) error {
+	for attempt := 0; ; attempt++ {
+		var stale []*logWindow
+		for i := len(lc.windows) - 1; i >= 0; i-- {
+			w := lc.windows[i]
+			h1, h2, err := lc.blockHashes(ctx, w.end)
+			if err != nil {
+				return err
 			}
-			idx := -1
-			for i := 0; i < min; i++ {
-				if s1[i] != s2[i] {
-					idx = i
-					break
+			if h1 == w.hash1 && h2 == w.hash2 {
+				if i == len(lc.windows)-1 {
+					continue
 				}
+				break
 			}
-			if idx != -1 {
-				log.Errorf("[range %d..%d] First mismatch at index %d:\nchain1: %s\nchain2: %s", start, windowEnd, idx, s1[idx], s2[idx])
-			} else if len(s1) != len(s2) {
-				log.Errorf("[range %d..%d] Log count differs: chain1=%d chain2=%d", start, windowEnd, len(s1), len(s2))
+			stale = append([]*logWindow{w}, stale...)
+		}
+		if len(stale) == 0 {
+			return nil
+		}
+		if attempt >= maxReorgRetries {
+			return fmt.Errorf("chain keeps reorganising at block %d, giving up after %d retries", stale[0].start, attempt)
+		}
+
+		log.Warnf("Reorg detected at or after block %d, recomputing %d window(s)", stale[0].start, len(stale))
+		switch {
+		case lc.diverged != 0 && lc.diverged < stale[0].start:
+			// The first differing block is older than the reorg and still differs.
+		case lc.diverged != 0 || lc.agreedAt >= stale[0].start:
+			// Every block before the reorg agreed, so the bisection can
+			// start right before it.
+			lc.agreedAt, lc.diverged = stale[0].start-1, 0
+		}
+		for _, w := range stale {
+			if err := lc.compareWindow(ctx, w); err != nil {
+				return err
 			}
-		} else {
-			okRanges++
-			log.Infof("[range %d..%d] Logs equal. count=%d sha256=%s", start, windowEnd, len(s1), hex.EncodeToString(h1[:]))
 		}
+	}
+}
+
+func (lc *logComparer) summary() error {
+	t := lc.totals()
+	log.Infof("comparelogs summary: ranges=%d ok=%d mismatch=%d totalLogs(chain1)=%d totalLogs(chain2)=%d", t.ok+t.mismatch, t.ok, t.mismatch, t.logs1, t.logs2)
+	if len(lc.addresses) > 1 {
+		lc.addressSummary(t)
+	}
+	if lc.diverged != 0 {
+		log.Errorf("comparelogs checkpoints: first differing block is %d", lc.diverged)
+	}
+	if t.anomalies1 > 0 || t.anomalies2 > 0 {
+		log.Errorf("comparelogs anomalies: chain1=%d chain2=%d", t.anomalies1, t.anomalies2)
+	}
+	if lc.verify != verifyNone {
+		log.Infof("comparelogs verify(%s): inconsistent(chain1)=%d inconsistent(chain2)=%d", lc.verify, t.invalid1, t.invalid2)
+	}
+	if t.mismatch > 0 {
+		return fmt.Errorf("found %d mismatching ranges", t.mismatch)
+	}
+	if t.anomalies1 > 0 || t.anomalies2 > 0 {
+		return fmt.Errorf("found log anomalies: chain1=%d chain2=%d", t.anomalies1, t.anomalies2)
+	}
+	if t.invalid1 > 0 || t.invalid2 > 0 {
+		return fmt.Errorf("logs inconsistent with headers: chain1=%d chain2=%d", t.invalid1, t.invalid2)
+	}
+	return nil
+}
+
+// totals adds up the pruned and the current windows.
+func (lc *logComparer) totals() logTotals {
+	t := lc.pruned
+	t.byAddress = make(map[common.Address]*addressTotals, len(lc.pruned.byAddress))
+	for addr, a := range lc.pruned.byAddress {
+		c := *a
+		t.byAddress[addr] = &c
+	}
+	for _, w := range lc.windows {
+		t.add(w)
+	}
+	return t
+}
+
+// openCheckpoints creates the checkpoint files requested in opts and returns
+// a function that closes them.
+func (lc *logComparer) openCheckpoints(ctx context.Context, opts compareLogsOptions) (func(), error) {
+	lc.checkpointInterval = opts.checkpointInterval
+	lc.agreedAt = opts.fromBlock - 1
 
-		if windowEnd == end {
+	header := checkpointHeader{
+		FromBlock:   opts.fromBlock,
+		Interval:    opts.checkpointInterval,
+		IgnoreOrder: lc.ignoreOrder,
+		Addresses:   lc.addresses,
+		Topics:      lc.topics,
+	}
+	var err error
+	if opts.checkpointFile1 != "" {
+		h := header
+		if h.ChainID, h.GenesisHash, err = chainIdentity(ctx, lc.c1); err != nil {
+			return nil, fmt.Errorf("chain1 identity: %w", err)
+		}
+		if lc.cp1, err = createCheckpointFile(opts.checkpointFile1, h); err != nil {
+			return nil, err
+		}
+	}
+	if opts.checkpointFile2 != "" {
+		h := header
+		if lc.snap != nil {
+			h.ChainID, h.GenesisHash = lc.snap.header.ChainID, lc.snap.header.GenesisHash
+		} else if h.ChainID, h.GenesisHash, err = chainIdentity(ctx, lc.c2); err != nil {
+			return nil, fmt.Errorf("chain2 identity: %w", err)
+		}
+		if lc.cp2, err = createCheckpointFile(opts.checkpointFile2, h); err != nil {
+			return nil, err
+		}
+	}
+	return func() {
+		if lc.cp1 != nil {
+			lc.cp1.Close()
+		}
+		if lc.cp2 != nil {
+			lc.cp2.Close()
+		}
+	}, nil
+}
+
+// digestsBefore returns the rolling digests of both chains right before the
+// first block of w.
+func (lc *logComparer) digestsBefore(w *logWindow) (logDigest, logDigest) {
+	prev := len(lc.windows) - 1
+	for i := len(lc.windows) - 1; i >= 0; i-- {
+		if lc.windows[i] == w {
+			prev = i - 1
 			break
 		}
-		start = windowEnd + 1
+	}
+	if prev < 0 {
+		return lc.base1, lc.base2
+	}
+	return lc.windows[prev].digest1, lc.windows[prev].digest2
+}
+
+// digestsAt returns the rolling digests of both chains right after block b.
+// cur is the window being compared, which may not be in lc.windows yet.
+func (lc *logComparer) digestsAt(b uint64, cur *logWindow) (logDigest, logDigest) {
+	w := cur
+	if w == nil || b < w.start || b > w.end {
+		for i := len(lc.windows) - 1; i >= 0; i-- {
+			if lc.windows[i].start <= b && b <= lc.windows[i].end {
+				w = lc.windows[i]
+				break
+			}
+		}
+	}
+	if b == w.end {
+		return w.digest1, w.digest2
+	}
+	base1, base2 := lc.digestsBefore(w)
+	return digestAt(base1, w.points1, b), digestAt(base2, w.points2, b)
+}
+
+// checkpoint compares and records the rolling digests after block b. On the
+// first disagreement it bisects back to the last agreeing checkpoint to find
+// the first block whose logs differ.
+func (lc *logComparer) checkpoint(b uint64, cur *logWindow) error {
+	d1, d2 := lc.digestsAt(b, cur)
+	if lc.cp1 != nil {
+		if err := lc.cp1.write(b, d1); err != nil {
+			return err
+		}
+	}
+	if lc.cp2 != nil {
+		if err := lc.cp2.write(b, d2); err != nil {
+			return err
+		}
+	}
+
+	if d1.hash == d2.hash {
+		log.Infof("[checkpoint %d] Digests equal. logs=%d digest=%s", b, d1.logs, d1.hash.Hex())
+		lc.agreedAt = b
+		for _, w := range lc.windows {
+			if w.end <= b {
+				w.points1, w.points2 = nil, nil
+			}
+		}
+		return nil
 	}
 
-	log.Infof("comparelogs summary: ranges=%d ok=%d mismatch=%d totalLogs(chain1)=%d totalLogs(chain2)=%d", totalRanges, okRanges, mismatchRanges, totalLogsChain1, totalLogsChain2)
-	if mismatchRanges > 0 {
-		return fmt.Errorf("found %d mismatching ranges", mismatchRanges)
+	if lc.diverged == 0 {
+		lo, hi := lc.agreedAt, b
+		for hi-lo > 1 {
+			mid := lo + (hi-lo)/2
+			m1, m2 := lc.digestsAt(mid, cur)
+			if m1.hash == m2.hash {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		lc.diverged = hi
 	}
+	log.Errorf("[checkpoint %d] Digests differ (chain1=%s logs=%d chain2=%s logs=%d); first differing block is %d",
+		b, d1.hash.Hex(), d1.logs, d2.hash.Hex(), d2.logs, lc.diverged)
 	return nil
 }
 
+// addressSummary logs the totals of every compared contract, mismatching
+// contracts as errors.
+func (lc *logComparer) addressSummary(t logTotals) {
+	for _, addr := range lc.addresses {
+		a := t.byAddress[addr]
+		if a == nil {
+			a = &addressTotals{}
+		}
+		if a.mismatch > 0 {
+			log.Errorf("comparelogs address %s: mismatch=%d totalLogs(chain1)=%d totalLogs(chain2)=%d", addr.Hex(), a.mismatch, a.logs1, a.logs2)
+		} else {
+			log.Infof("comparelogs address %s: ok totalLogs(chain1)=%d totalLogs(chain2)=%d", addr.Hex(), a.logs1, a.logs2)
+		}
+	}
+}
+
+// loadAddresses merges the --address values and the contents of the
+// --address-file into one list without duplicates. The file is either a JSON
+// array of addresses or one address per line; blank lines and lines starting
+// with # are skipped.
+func loadAddresses(flagValues []string, file string) ([]common.Address, error) {
+	raw := make([]string, 0, len(flagValues))
+	raw = append(raw, flagValues...)
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+			var list []string
+			if err := json.Unmarshal(data, &list); err != nil {
+				return nil, fmt.Errorf("parse %s: %w", file, err)
+			}
+			raw = append(raw, list...)
+		} else {
+			for _, line := range strings.Split(trimmed, "\n") {
+				line = strings.TrimSpace(line)
+				if line == "" || strings.HasPrefix(line, "#") {
+					continue
+				}
+				raw = append(raw, line)
+			}
+		}
+	}
+
+	seen := make(map[common.Address]bool, len(raw))
+	res := make([]common.Address, 0, len(raw))
+	for _, s := range raw {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !common.IsHexAddress(s) {
+			return nil, fmt.Errorf("not an address: %s", s)
+		}
+		a := common.HexToAddress(s)
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+		res = append(res, a)
+	}
+	return res, nil
+}
+
+// chainIdentity returns the chain id and genesis hash of c.
+func chainIdentity(ctx context.Context, c *ethclient.Client) (*big.Int, common.Hash, error) {
+	chainID, err := c.ChainID(ctx)
+	if err != nil {
+		return nil, common.Hash{}, err
+	}
+	genesis, err := c.HeaderByNumber(ctx, big.NewInt(0))
+	if err != nil {
+		return nil, common.Hash{}, err
+	}
+	return chainID, genesis.Hash(), nil
+}
+
+// blockSpec is a --to-block value: either an explicit height or a block tag
+// that is resolved on each chain separately.
+type blockSpec struct {
+	number uint64
+	tag    string // "latest", "finalized" or "safe"; empty for an explicit height
+}
+
+func parseBlockSpec(s string) (blockSpec, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "", "0", "latest":
+		return blockSpec{tag: "latest"}, nil
+	case "finalized", "safe":
+		return blockSpec{tag: s}, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return blockSpec{}, fmt.Errorf("invalid block %q: want a number or latest|finalized|safe", s)
+	}
+	return blockSpec{number: n}, nil
+}
+
+func (b blockSpec) isTag() bool {
+	return b.tag != ""
+}
+
+func (b blockSpec) String() string {
+	if b.isTag() {
+		return b.tag
+	}
+	return strconv.FormatUint(b.number, 10)
+}
+
+// resolve returns the height the spec refers to on the given chain. For tags,
+// confirmations are subtracted from the resolved head; explicit heights are
+// returned as is.
+func (b blockSpec) resolve(ctx context.Context, c *ethclient.Client, confirmations uint64) (uint64, error) {
+	var head uint64
+	switch b.tag {
+	case "":
+		return b.number, nil
+	case "latest":
+		n, err := c.BlockNumber(ctx)
+		if err != nil {
+			return 0, err
+		}
+		head = n
+	default:
+		tag := rpc.FinalizedBlockNumber
+		if b.tag == "safe" {
+			tag = rpc.SafeBlockNumber
+		}
+		h, err := c.HeaderByNumber(ctx, big.NewInt(tag.Int64()))
+		if err != nil {
+			return 0, err
+		}
+		head = h.Number.Uint64()
+	}
+	if head < confirmations {
+		return 0, nil
+	}
+	return head - confirmations, nil
+}
+
 func canonicalizeLogs(in []types.Log, ignoreOrder bool) []string {
 	out := make([]string, 0, len(in))
 	for _, l := range in {
@@ -0,0 +1,393 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// testHeads serves the heads blockSpec.resolve reads.
+type testHeads struct {
+	latest, finalized, safe uint64
+}
+
+func (h *testHeads) BlockNumber() hexutil.Uint64 {
+	return hexutil.Uint64(h.latest)
+}
+
+func (h *testHeads) GetBlockByNumber(n rpc.BlockNumber, full bool) (*types.Header, error) {
+	number := uint64(n)
+	switch n {
+	case rpc.LatestBlockNumber:
+		number = h.latest
+	case rpc.FinalizedBlockNumber:
+		number = h.finalized
+	case rpc.SafeBlockNumber:
+		number = h.safe
+	}
+	return &types.Header{Number: new(big.Int).SetUint64(number), Difficulty: new(big.Int)}, nil
+}
+
+// newTestClient returns a client of an in-process server with service
+// registered under the eth namespace.
+func newTestClient(t *testing.T, service interface{}) *ethclient.Client {
+	t.Helper()
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("eth", service); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Stop)
+	c := ethclient.NewClient(rpc.DialInProc(srv))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// testForkChain is a chain that can be reorganised: forks holds the branch
+// of every block, and blocks on different branches have different hashes,
+// transactions and logs. Every block has one transaction and one log of
+// testLogAddress. Blocks reorged away are still served by hash.
+type testForkChain struct {
+	mu       sync.Mutex
+	forks    []byte
+	blocks   []*types.Block
+	byHash   map[common.Hash]*types.Block
+	failLogs int // number of eth_getLogs calls still to fail
+
+	// subs are the newHeads subscriptions, subscribed counts them all.
+	subs       map[rpc.ID]*rpc.Notifier
+	subscribed int
+}
+
+var testLogAddress = common.HexToAddress("0x1000000000000000000000000000000000000001")
+
+// newTestForkChain returns a chain with blocks 0..head on branch 0.
+func newTestForkChain(head uint64) *testForkChain {
+	c := &testForkChain{byHash: make(map[common.Hash]*types.Block)}
+	c.extend(head)
+	return c
+}
+
+// extend adds blocks up to head on the branch of the current head.
+func (c *testForkChain) extend(head uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var fork byte
+	if len(c.forks) > 0 {
+		fork = c.forks[len(c.forks)-1]
+	}
+	for uint64(len(c.forks)) <= head {
+		c.forks = append(c.forks, fork)
+	}
+	c.build()
+	for id, notifier := range c.subs {
+		notifier.Notify(id, c.blocks[len(c.blocks)-1].Header())
+	}
+}
+
+// reorg moves the blocks from from onwards to branch fork.
+func (c *testForkChain) reorg(from uint64, fork byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for n := from; n < uint64(len(c.forks)); n++ {
+		c.forks[n] = fork
+	}
+	c.build()
+}
+
+func (c *testForkChain) build() {
+	c.blocks = c.blocks[:0]
+	var parent common.Hash
+	for n, fork := range c.forks {
+		tx := types.NewTx(&types.LegacyTx{Nonce: uint64(n), Gas: 21000, GasPrice: big.NewInt(1), Data: []byte{fork}})
+		header := &types.Header{ParentHash: parent, Number: big.NewInt(int64(n)), GasLimit: 30000000, GasUsed: 21000, Time: uint64(1000 + 12*n), Extra: []byte{fork}, Difficulty: new(big.Int)}
+		block := types.NewBlock(header, []*types.Transaction{tx}, nil, nil, trie.NewStackTrie(nil))
+		c.blocks = append(c.blocks, block)
+		c.byHash[block.Hash()] = block
+		parent = block.Hash()
+	}
+}
+
+// NewHeads serves newHeads subscriptions, notified by extend.
+func (c *testForkChain) NewHeads(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, ok := rpc.NotifierFromContext(ctx)
+	if !ok {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+	sub := notifier.CreateSubscription()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subs == nil {
+		c.subs = make(map[rpc.ID]*rpc.Notifier)
+	}
+	c.subs[sub.ID] = notifier
+	c.subscribed++
+	go func() {
+		<-sub.Err()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		delete(c.subs, sub.ID)
+	}()
+	return sub, nil
+}
+
+func (c *testForkChain) subscriptions() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subscribed
+}
+
+func (c *testForkChain) BlockNumber() hexutil.Uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return hexutil.Uint64(len(c.blocks) - 1)
+}
+
+func (c *testForkChain) GetBlockByNumber(n rpc.BlockNumber, full bool) (map[string]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := int(n)
+	if n < 0 {
+		i = len(c.blocks) - 1
+	}
+	if i >= len(c.blocks) {
+		return nil, nil
+	}
+	return marshalBlock(c.blocks[i])
+}
+
+func (c *testForkChain) GetBlockByHash(hash common.Hash, full bool) (map[string]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if b := c.byHash[hash]; b != nil {
+		return marshalBlock(b)
+	}
+	return nil, nil
+}
+
+type testFilter struct {
+	FromBlock hexutil.Uint64   `json:"fromBlock"`
+	ToBlock   hexutil.Uint64   `json:"toBlock"`
+	Address   []common.Address `json:"address"`
+}
+
+func (c *testForkChain) GetLogs(q testFilter) ([]types.Log, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failLogs > 0 {
+		c.failLogs--
+		return nil, errors.New("upstream timeout")
+	}
+	logs := []types.Log{}
+	for n := uint64(q.FromBlock); n <= uint64(q.ToBlock) && n < uint64(len(c.blocks)); n++ {
+		b := c.blocks[n]
+		logs = append(logs, types.Log{
+			Address:     testLogAddress,
+			Topics:      []common.Hash{},
+			Data:        []byte{c.forks[n]},
+			BlockNumber: n,
+			TxHash:      b.Transactions()[0].Hash(),
+			BlockHash:   b.Hash(),
+		})
+	}
+	return logs, nil
+}
+
+func TestParseBlockSpec(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    blockSpec
+		wantErr bool
+	}{
+		{in: "", want: blockSpec{tag: "latest"}},
+		{in: "0", want: blockSpec{tag: "latest"}},
+		{in: "latest", want: blockSpec{tag: "latest"}},
+		{in: " Finalized ", want: blockSpec{tag: "finalized"}},
+		{in: "SAFE", want: blockSpec{tag: "safe"}},
+		{in: "17000000", want: blockSpec{number: 17000000}},
+		{in: "pending", wantErr: true},
+		{in: "0x10", wantErr: true},
+		{in: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBlockSpec(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBlockSpec(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseBlockSpec(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBlockSpecResolve(t *testing.T) {
+	c := newTestClient(t, &testHeads{latest: 100, finalized: 80, safe: 90})
+	tests := []struct {
+		spec          blockSpec
+		confirmations uint64
+		want          uint64
+	}{
+		{spec: blockSpec{number: 50}, confirmations: 10, want: 50},
+		{spec: blockSpec{tag: "latest"}, want: 100},
+		{spec: blockSpec{tag: "latest"}, confirmations: 10, want: 90},
+		{spec: blockSpec{tag: "finalized"}, confirmations: 5, want: 75},
+		{spec: blockSpec{tag: "safe"}, want: 90},
+		{spec: blockSpec{tag: "latest"}, confirmations: 100, want: 0},
+		{spec: blockSpec{tag: "latest"}, confirmations: 200, want: 0},
+	}
+	for _, tt := range tests {
+		got, err := tt.spec.resolve(context.Background(), c, tt.confirmations)
+		if err != nil {
+			t.Errorf("%s.resolve(%d): %v", tt.spec, tt.confirmations, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s.resolve(%d) = %d, want %d", tt.spec, tt.confirmations, got, tt.want)
+		}
+	}
+}
+
+func TestMergeLogChunks(t *testing.T) {
+	lg := func(block uint64, index uint) types.Log { return types.Log{BlockNumber: block, Index: index} }
+	tests := []struct {
+		name   string
+		chunks [][]types.Log
+		want   []types.Log
+	}{
+		{name: "none"},
+		{name: "one chunk", chunks: [][]types.Log{{lg(1, 0), lg(2, 0)}}, want: []types.Log{lg(1, 0), lg(2, 0)}},
+		{
+			name:   "interleaved",
+			chunks: [][]types.Log{{lg(1, 0), lg(1, 2), lg(3, 1)}, {}, {lg(1, 1), lg(2, 0), lg(3, 0)}},
+			want:   []types.Log{lg(1, 0), lg(1, 1), lg(1, 2), lg(2, 0), lg(3, 0), lg(3, 1)},
+		},
+		{
+			// A misordered chunk stays misordered for checkLogs to see.
+			name:   "misordered chunk",
+			chunks: [][]types.Log{{lg(1, 5), lg(1, 3)}, {lg(1, 4)}},
+			want:   []types.Log{lg(1, 4), lg(1, 5), lg(1, 3)},
+		},
+	}
+	for _, tt := range tests {
+		got := mergeLogChunks(tt.chunks)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: merged %d logs, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if got[i].BlockNumber != tt.want[i].BlockNumber || got[i].Index != tt.want[i].Index {
+				t.Errorf("%s: log %d is %d/%d, want %d/%d", tt.name, i, got[i].BlockNumber, got[i].Index, tt.want[i].BlockNumber, tt.want[i].Index)
+			}
+		}
+	}
+}
+
+func TestFetchChainInfoWithoutNetVersion(t *testing.T) {
+	chain := newTestChain(3, func(int) int { return 0 })
+	info, err := fetchChainInfo(context.Background(), newTestClient(t, chain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.chainID.Uint64() != testChainID || info.genesis != chain.blocks[0].Hash() || info.head != 2 {
+		t.Errorf("got chain id %s, genesis %s, head %d", info.chainID, info.genesis.Hex(), info.head)
+	}
+	if info.networkID != nil {
+		t.Errorf("got network id %s without net_version", info.networkID)
+	}
+}
+
+func TestLogComparerFollowReorg(t *testing.T) {
+	chain1, chain2 := newTestForkChain(20), newTestForkChain(20)
+	lc := &logComparer{c1: newTestClient(t, chain1), c2: newTestClient(t, chain2), addresses: []common.Address{testLogAddress}}
+	metrics.Enabled, metricsRegistry = true, metrics.NewRegistry()
+	defer func() { metrics.Enabled, metricsRegistry = false, metrics.NewRegistry() }()
+
+	// follow runs the follow loop for a while and returns where it stopped.
+	next := uint64(1)
+	follow := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		if err := lc.follow(ctx, next, blockSpec{tag: "latest"}, 0, 10*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("follow returned %v", err)
+		}
+		next = lc.windows[len(lc.windows)-1].end + 1
+	}
+	steps := []struct {
+		name     string
+		change   func()
+		ok       uint64
+		mismatch uint64
+	}{
+		// The failed comparison is retried on the next tick.
+		{name: "failing chain2", change: func() { chain2.failLogs = 1 }, ok: 1},
+		// The recomputed window 1..20 is counted once.
+		{name: "chain2 reorged", change: func() { chain2.reorg(15, 1); chain1.extend(30); chain2.extend(30) }, mismatch: 2},
+		{name: "chain1 reorged the same way", change: func() { chain1.reorg(15, 1); chain1.extend(40); chain2.extend(40) }, ok: 3},
+	}
+	for _, step := range steps {
+		step.change()
+		follow()
+		if next != uint64(len(chain1.forks)) {
+			t.Errorf("%s: compared up to %d, want %d", step.name, next-1, len(chain1.forks)-1)
+		}
+		totals := lc.totals()
+		if totals.ok != step.ok || totals.mismatch != step.mismatch {
+			t.Errorf("%s: %d ok and %d mismatched windows, want %d and %d", step.name, totals.ok, totals.mismatch, step.ok, step.mismatch)
+		}
+		if got := counterMetric(compareMismatchMetric).Count(); got != int64(step.mismatch) {
+			t.Errorf("%s: mismatch metric %d, want %d", step.name, got, step.mismatch)
+		}
+	}
+}
+
+func TestLogComparerPrune(t *testing.T) {
+	chain1, chain2 := newTestForkChain(1000), newTestForkChain(1000)
+	lc := &logComparer{c1: newTestClient(t, chain1), c2: newTestClient(t, chain2), addresses: []common.Address{testLogAddress}}
+	steps := []struct {
+		name     string
+		change   func()
+		from, to uint64
+		windows  int // kept in lc.windows
+		pruned   uint64
+		ok       uint64
+		mismatch uint64
+	}{
+		// 1..300 and 301..600 end more than reorgWindow blocks before 1000.
+		{name: "first range", from: 1, to: 1000, windows: 2, pruned: 2, ok: 4},
+		// 901..1000 is recomputed, 601..900 is intact and then pruned.
+		{
+			name:   "reorg in a kept window",
+			change: func() { chain2.reorg(950, 1); chain1.extend(1100); chain2.extend(1100) },
+			from:   1001, to: 1100, windows: 2, pruned: 3, ok: 3, mismatch: 2,
+		},
+	}
+	for _, step := range steps {
+		if step.change != nil {
+			step.change()
+		}
+		if err := lc.compareRange(context.Background(), step.from, step.to); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if len(lc.windows) != step.windows || lc.pruned.ok+lc.pruned.mismatch != step.pruned {
+			t.Errorf("%s: %d windows kept and %d pruned, want %d and %d", step.name, len(lc.windows), lc.pruned.ok+lc.pruned.mismatch, step.windows, step.pruned)
+		}
+		totals := lc.totals()
+		if totals.ok != step.ok || totals.mismatch != step.mismatch {
+			t.Errorf("%s: %d ok and %d mismatched windows, want %d and %d", step.name, totals.ok, totals.mismatch, step.ok, step.mismatch)
+		}
+		if totals.logs1 != step.to || totals.logs2 != step.to {
+			t.Errorf("%s: %d and %d logs, want %d", step.name, totals.logs1, totals.logs2, step.to)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	OutputFlag   = "output"
+	SnapshotFlag = "snapshot"
+)
+
+// logSnapshotVersion is the version of the snapshot file format written by
+// exportlogs. Readers refuse files with a different version.
+const logSnapshotVersion = 1
+
+// exportLogsCmd represents the export logs command
+var exportLogsCmd = &cobra.Command{
+	Use:   "exportlogs",
+	Short: "Export the logs of a block range into a snapshot file (comparelogs --snapshot) or a checkpoint file",
+	Run: func(cmd *cobra.Command, args []string) {
+		chainEndpoint, _ := cmd.Flags().GetString(ChainEndpointFlag)
+		fromBlock, _ := cmd.Flags().GetUint64(FromBlockFlag)
+		toBlockStr, _ := cmd.Flags().GetString(ToBlockFlag)
+		confirmations, _ := cmd.Flags().GetUint64(ConfirmationsFlag)
+		addrStrs, _ := cmd.Flags().GetStringSlice(AddressFlag)
+		addrFile, _ := cmd.Flags().GetString(AddressFileFlag)
+		maxAddresses, _ := cmd.Flags().GetInt(MaxAddressesFlag)
+		topicsRaw, _ := cmd.Flags().GetStringSlice(TopicsFlag)
+		output, _ := cmd.Flags().GetString(OutputFlag)
+		checkpointFile, _ := cmd.Flags().GetString(CheckpointFileFlag)
+		checkpointInterval, _ := cmd.Flags().GetUint64(CheckpointIntervalFlag)
+		ignoreOrder, _ := cmd.Flags().GetBool(IgnoreOrderFlag)
+
+		if chainEndpoint == "" {
+			log.Error("Chain endpoint is required")
+			return
+		}
+		if output == "" && checkpointFile == "" {
+			log.Error("At least one of --output and --checkpoint-file is required")
+			return
+		}
+		if checkpointFile != "" && checkpointInterval == 0 {
+			log.Error("--checkpoint-file requires --checkpoint-interval")
+			return
+		}
+		if fromBlock == 0 {
+			log.Error("--from-block is required (must be > 0)")
+			return
+		}
+		toBlock, err := parseBlockSpec(toBlockStr)
+		if err != nil {
+			log.WithError(err).Error("Invalid --to-block")
+			return
+		}
+		addresses, err := loadAddresses(addrStrs, addrFile)
+		if err != nil {
+			log.WithError(err).Error("Invalid --address/--address-file")
+			return
+		}
+		topics, err := parseTopics(topicsRaw)
+		if err != nil {
+			log.WithError(err).Error("Invalid --topics")
+			return
+		}
+
+		err = doExportLogs(cmd.Context(), chainEndpoint, exportLogsOptions{
+			output:             output,
+			fromBlock:          fromBlock,
+			toBlock:            toBlock,
+			confirmations:      confirmations,
+			addresses:          addresses,
+			maxAddresses:       maxAddresses,
+			topics:             topics,
+			checkpointFile:     checkpointFile,
+			checkpointInterval: checkpointInterval,
+			ignoreOrder:        ignoreOrder,
+		})
+		if err != nil {
+			log.WithError(err).Error("exportlogs failed")
+			return
+		}
+	},
+}
+
+func init() {
+	exportLogsCmd.Flags().String(ChainEndpointFlag, "", "Chain endpoint URL")
+	exportLogsCmd.Flags().String(OutputFlag, "", "Snapshot file to write")
+	exportLogsCmd.Flags().String(CheckpointFileFlag, "", "Checkpoint file to write (see comparecheckpoints)")
+	exportLogsCmd.Flags().Uint64(CheckpointIntervalFlag, 0, "Write a rolling log digest to --checkpoint-file every N blocks")
+	exportLogsCmd.Flags().Bool(IgnoreOrderFlag, true, "Ignore log ordering within a block for the checkpoint digests")
+	exportLogsCmd.Flags().Uint64(FromBlockFlag, 0, "Start block (inclusive)")
+	exportLogsCmd.Flags().String(ToBlockFlag, "0", "End block (inclusive): a block number or latest|finalized|safe. 0 means latest")
+	exportLogsCmd.Flags().Uint64(ConfirmationsFlag, 0, "Stay this many blocks behind the latest/finalized/safe head")
+	exportLogsCmd.Flags().StringSlice(AddressFlag, nil, "Contract address to filter (optional, repeatable)")
+	exportLogsCmd.Flags().String(AddressFileFlag, "", "File with contract addresses to filter: a JSON array or one address per line")
+	exportLogsCmd.Flags().Int(MaxAddressesFlag, 1000, "Maximum number of addresses per FilterLogs call. 0 means no limit")
+	exportLogsCmd.Flags().StringSlice(TopicsFlag, nil, "Topics to filter, same format as comparelogs --topics")
+
+	_ = exportLogsCmd.MarkFlagRequired(ChainEndpointFlag)
+	_ = exportLogsCmd.MarkFlagRequired(FromBlockFlag)
+
+	rootCmd.AddCommand(exportLogsCmd)
+}
+
+// logSnapshotHeader is the first line of a snapshot file. It records where
+// the logs came from and which filter was used to fetch them.
+type logSnapshotHeader struct {
+	Version     int              `json:"version"`
+	ChainID     *big.Int         `json:"chainId"`
+	GenesisHash common.Hash      `json:"genesisHash"`
+	FromBlock   uint64           `json:"fromBlock"`
+	ToBlock     uint64           `json:"toBlock"`
+	Addresses   []common.Address `json:"addresses,omitempty"`
+	Topics      [][]common.Hash  `json:"topics,omitempty"`
+	CreatedAt   time.Time        `json:"createdAt"`
+}
+
+// logSnapshotEntry is every following line of a snapshot file: one log in
+// the form produced by canonicalizeLogs.
+type logSnapshotEntry struct {
+	Block uint64 `json:"block"`
+	Log   string `json:"log"`
+}
+
+// exportLogsOptions holds everything doExportLogs needs besides the
+// endpoint. Either output or checkpointFile may be empty.
+type exportLogsOptions struct {
+	output        string
+	fromBlock     uint64
+	toBlock       blockSpec
+	confirmations uint64
+	addresses     []common.Address
+	maxAddresses  int
+	topics        [][]common.Hash
+
+	checkpointFile     string
+	checkpointInterval uint64
+	ignoreOrder        bool
+}
+
+func doExportLogs(ctx context.Context, chainEndpoint string, opts exportLogsOptions) error {
+	client, err := ethclient.DialContext(ctx, chainEndpoint)
+	if err != nil {
+		return fmt.Errorf("dial chain: %w", err)
+	}
+	defer client.Close()
+
+	end, err := opts.toBlock.resolve(ctx, client, opts.confirmations)
+	if err != nil {
+		return fmt.Errorf("%s block: %w", opts.toBlock, err)
+	}
+	if opts.fromBlock > end {
+		return fmt.Errorf("from-block (%d) is greater than to-block (%d)", opts.fromBlock, end)
+	}
+	chainID, genesisHash, err := chainIdentity(ctx, client)
+	if err != nil {
+		return fmt.Errorf("chain identity: %w", err)
+	}
+
+	// The snapshot is written to a temporary file and only renamed to
+	// opts.output once complete, so that a failed or interrupted export never
+	// leaves a truncated snapshot behind.
+	var (
+		f   *os.File
+		w   *bufio.Writer
+		enc *json.Encoder
+	)
+	if opts.output != "" {
+		tmp := opts.output + ".tmp"
+		if f, err = os.Create(tmp); err != nil {
+			return err
+		}
+		defer func() {
+			if f != nil {
+				f.Close()
+			}
+			os.Remove(tmp) // already gone after the rename
+		}()
+		w = bufio.NewWriter(f)
+		enc = json.NewEncoder(w)
+
+		header := logSnapshotHeader{
+			Version:     logSnapshotVersion,
+			ChainID:     chainID,
+			GenesisHash: genesisHash,
+			FromBlock:   opts.fromBlock,
+			ToBlock:     end,
+			Addresses:   opts.addresses,
+			Topics:      opts.topics,
+			CreatedAt:   time.Now().UTC(),
+		}
+		if err := enc.Encode(header); err != nil {
+			return err
+		}
+	}
+
+	var cw *checkpointWriter
+	if opts.checkpointFile != "" {
+		cw, err = createCheckpointFile(opts.checkpointFile, checkpointHeader{
+			ChainID:     chainID,
+			GenesisHash: genesisHash,
+			FromBlock:   opts.fromBlock,
+			Interval:    opts.checkpointInterval,
+			IgnoreOrder: opts.ignoreOrder,
+			Addresses:   opts.addresses,
+			Topics:      opts.topics,
+		})
+		if err != nil {
+			return err
+		}
+		defer cw.Close()
+	}
+
+	var (
+		total  uint64
+		digest logDigest
+	)
+	for start := opts.fromBlock; start <= end; {
+		windowEnd := start + MaxBlocksPerRequest - 1
+		if windowEnd > end {
+			windowEnd = end
+		}
+
+		logs, err := filterLogsChunked(ctx, client, start, windowEnd, opts.addresses, opts.maxAddresses, opts.topics)
+		if err != nil {
+			return fmt.Errorf("FilterLogs [%d..%d]: %w", start, windowEnd, err)
+		}
+		if enc != nil {
+			for i, s := range canonicalizeLogs(logs, false) {
+				if err := enc.Encode(logSnapshotEntry{Block: logs[i].BlockNumber, Log: s}); err != nil {
+					return err
+				}
+			}
+		}
+		if cw != nil {
+			base := digest
+			var points []digestPoint
+			digest, points = digestLogs(base, logs, opts.ignoreOrder)
+			for b := start; b <= windowEnd; b++ {
+				if isCheckpoint(b, opts.checkpointInterval) || b == end {
+					if err := cw.write(b, digestAt(base, points, b)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		total += uint64(len(logs))
+		log.Infof("[range %d..%d] Exported %d logs", start, windowEnd, len(logs))
+
+		if windowEnd == end {
+			break
+		}
+		start = windowEnd + 1
+	}
+
+	if f != nil {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		err := f.Close()
+		f = nil
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(opts.output+".tmp", opts.output); err != nil {
+			return err
+		}
+	}
+	log.Infof("exportlogs summary: chainId=%s blocks=%d..%d totalLogs=%d", chainID, opts.fromBlock, end, total)
+	return nil
+}
+
+// logSnapshot is a snapshot file loaded into memory, ordered by block.
+type logSnapshot struct {
+	header logSnapshotHeader
+	logs   []types.Log
+}
+
+func loadLogSnapshot(path string) (*logSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: empty snapshot", path)
+	}
+	snap := &logSnapshot{}
+	if err := json.Unmarshal(scanner.Bytes(), &snap.header); err != nil {
+		return nil, fmt.Errorf("%s: header: %w", path, err)
+	}
+	if snap.header.Version != logSnapshotVersion {
+		return nil, fmt.Errorf("%s: unsupported snapshot version %d (want %d)", path, snap.header.Version, logSnapshotVersion)
+	}
+
+	for line := 2; scanner.Scan(); line++ {
+		var entry logSnapshotEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		l, err := parseCanonicalLog(entry.Log)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		snap.logs = append(snap.logs, l)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(snap.logs, func(i, j int) bool {
+		if snap.logs[i].BlockNumber != snap.logs[j].BlockNumber {
+			return snap.logs[i].BlockNumber < snap.logs[j].BlockNumber
+		}
+		return snap.logs[i].Index < snap.logs[j].Index
+	})
+	return snap, nil
+}
+
+// FilterLogs returns the recorded logs that match q, like eth_getLogs would
+// have at the time the snapshot was taken.
+func (s *logSnapshot) FilterLogs(q ethereum.FilterQuery) []types.Log {
+	from, to := q.FromBlock.Uint64(), q.ToBlock.Uint64()
+	i := sort.Search(len(s.logs), func(i int) bool { return s.logs[i].BlockNumber >= from })
+
+	var res []types.Log
+	for ; i < len(s.logs) && s.logs[i].BlockNumber <= to; i++ {
+		if matchesFilter(&s.logs[i], q.Addresses, q.Topics) {
+			res = append(res, s.logs[i])
+		}
+	}
+	return res
+}
+
+// parseCanonicalLog is the inverse of canonicalizeLogs for a single log.
+func parseCanonicalLog(s string) (types.Log, error) {
+	parts := strings.Split(s, "|")
+	if len(parts) != 8 {
+		return types.Log{}, fmt.Errorf("malformed log %q", s)
+	}
+	blockNumber, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return types.Log{}, fmt.Errorf("block number: %w", err)
+	}
+	txIndex, err := strconv.ParseUint(parts[2], 10, 32)
+	if err != nil {
+		return types.Log{}, fmt.Errorf("tx index: %w", err)
+	}
+	index, err := strconv.ParseUint(parts[4], 10, 32)
+	if err != nil {
+		return types.Log{}, fmt.Errorf("log index: %w", err)
+	}
+	data, err := hex.DecodeString(parts[6])
+	if err != nil {
+		return types.Log{}, fmt.Errorf("data: %w", err)
+	}
+	var topics []common.Hash
+	if parts[7] != "" {
+		for _, t := range strings.Split(parts[7], ",") {
+			topics = append(topics, common.HexToHash(t))
+		}
+	}
+	return types.Log{
+		BlockNumber: blockNumber,
+		BlockHash:   common.HexToHash(parts[1]),
+		TxIndex:     uint(txIndex),
+		TxHash:      common.HexToHash(parts[3]),
+		Index:       uint(index),
+		Address:     common.HexToAddress(parts[5]),
+		Data:        data,
+		Topics:      topics,
+	}, nil
+}
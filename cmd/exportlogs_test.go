@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestParseCanonicalLog(t *testing.T) {
+	tests := []struct {
+		name string
+		log  types.Log
+	}{
+		{name: "no data or topics", log: types.Log{BlockNumber: 1, Address: common.HexToAddress("0x01")}},
+		{name: "full", log: types.Log{
+			BlockNumber: 17000000,
+			BlockHash:   common.HexToHash("0xb1"),
+			TxIndex:     3,
+			TxHash:      common.HexToHash("0xa1"),
+			Index:       42,
+			Address:     common.HexToAddress("0xdac17f958d2ee523a2206206994597c13d831ec7"),
+			Data:        []byte{0xde, 0xad, 0xbe, 0xef},
+			Topics:      []common.Hash{common.HexToHash("0x11"), common.HexToHash("0x22")},
+		}},
+	}
+	for _, tt := range tests {
+		s := canonicalizeLogs([]types.Log{tt.log}, false)[0]
+		got, err := parseCanonicalLog(s)
+		if err != nil {
+			t.Errorf("%s: parseCanonicalLog(%q): %v", tt.name, s, err)
+			continue
+		}
+		if !bytes.Equal(got.Data, tt.log.Data) {
+			t.Errorf("%s: data = %x, want %x", tt.name, got.Data, tt.log.Data)
+		}
+		got.Data, tt.log.Data = nil, nil
+		if !reflect.DeepEqual(got, tt.log) {
+			t.Errorf("%s: parseCanonicalLog(%q) = %+v, want %+v", tt.name, s, got, tt.log)
+		}
+	}
+}
+
+func TestParseCanonicalLogErrors(t *testing.T) {
+	hash := common.Hash{}.Hex()
+	addr := common.Address{}.Hex()
+	tests := []string{
+		"",
+		"1|" + hash + "|0|" + hash + "|0|" + addr + "|",
+		"x|" + hash + "|0|" + hash + "|0|" + addr + "||",
+		"1|" + hash + "|-1|" + hash + "|0|" + addr + "||",
+		"1|" + hash + "|0|" + hash + "|x|" + addr + "||",
+		"1|" + hash + "|0|" + hash + "|0|" + addr + "|zz|",
+	}
+	for _, s := range tests {
+		if _, err := parseCanonicalLog(s); err == nil {
+			t.Errorf("parseCanonicalLog(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func writeTestSnapshot(t *testing.T, header interface{}, logs []types.Log) string {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	if err := enc.Encode(header); err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range canonicalizeLogs(logs, false) {
+		if err := enc.Encode(logSnapshotEntry{Block: logs[i].BlockNumber, Log: s}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "snapshot.jsonl")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLogSnapshotRoundTrip(t *testing.T) {
+	token := common.HexToAddress("0xdac17f958d2ee523a2206206994597c13d831ec7")
+	other := common.HexToAddress("0x02")
+	transfer := common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef")
+	header := logSnapshotHeader{
+		Version:     logSnapshotVersion,
+		ChainID:     big.NewInt(1),
+		GenesisHash: common.HexToHash("0xd4e5"),
+		FromBlock:   10,
+		ToBlock:     20,
+		Addresses:   []common.Address{token, other},
+		Topics:      [][]common.Hash{{transfer}},
+		CreatedAt:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	// Out of order, as the snapshot is sorted when loaded.
+	logs := []types.Log{
+		{BlockNumber: 15, Index: 1, Address: token, Topics: []common.Hash{transfer}},
+		{BlockNumber: 12, Index: 0, Address: other, Topics: []common.Hash{transfer}},
+		{BlockNumber: 15, Index: 0, Address: other, Topics: []common.Hash{transfer}},
+		{BlockNumber: 20, Index: 7, Address: token, Topics: []common.Hash{transfer}},
+	}
+	snap, err := loadLogSnapshot(writeTestSnapshot(t, header, logs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snap.header, header) {
+		t.Errorf("header = %+v, want %+v", snap.header, header)
+	}
+
+	tests := []struct {
+		from, to  uint64
+		addresses []common.Address
+		want      [][2]uint64 // block, index
+	}{
+		{from: 10, to: 20, want: [][2]uint64{{12, 0}, {15, 0}, {15, 1}, {20, 7}}},
+		{from: 13, to: 15, want: [][2]uint64{{15, 0}, {15, 1}}},
+		{from: 10, to: 20, addresses: []common.Address{token}, want: [][2]uint64{{15, 1}, {20, 7}}},
+		{from: 16, to: 19},
+	}
+	for _, tt := range tests {
+		got := snap.FilterLogs(ethereum.FilterQuery{FromBlock: uint64ToBig(tt.from), ToBlock: uint64ToBig(tt.to), Addresses: tt.addresses})
+		var pos [][2]uint64
+		for _, l := range got {
+			pos = append(pos, [2]uint64{l.BlockNumber, uint64(l.Index)})
+		}
+		if !reflect.DeepEqual(pos, tt.want) {
+			t.Errorf("FilterLogs(%d..%d, %v) = %v, want %v", tt.from, tt.to, tt.addresses, pos, tt.want)
+		}
+	}
+}
+
+func TestLoadLogSnapshotErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		header interface{}
+	}{
+		{name: "other version", header: logSnapshotHeader{Version: logSnapshotVersion + 1}},
+		{name: "not a header", header: []int{1}},
+	}
+	for _, tt := range tests {
+		if _, err := loadLogSnapshot(writeTestSnapshot(t, tt.header, nil)); err == nil {
+			t.Errorf("%s: loadLogSnapshot succeeded, want an error", tt.name)
+		}
+	}
+
+	empty := filepath.Join(t.TempDir(), "empty.jsonl")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadLogSnapshot(empty); err == nil {
+		t.Error("loadLogSnapshot of an empty file succeeded, want an error")
+	}
+}
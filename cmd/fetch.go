@@ -2,11 +2,17 @@ package cmd
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"math"
 	"math/big"
+	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,6 +22,10 @@ const (
 	TargetUrlFlag   = "target-url"
 	BeginBlockFlag  = "begin-block"
 	TxBatchSizeFlag = "tx-batch-size"
+	StateFileFlag   = "state-file"
+	ResumeFlag      = "resume"
+	OverwriteFlag   = "overwrite-state"
+	EndBlockFlag    = "end-block"
 )
 
 // fetchCmd represents the fetch command
@@ -34,154 +44,494 @@ var fetchCmd = &cobra.Command{
 			return
 		}
 		beginBlock, _ := cmd.Flags().GetUint64(BeginBlockFlag)
-		if beginBlock == 0 {
+		resume, _ := cmd.Flags().GetBool(ResumeFlag)
+		if beginBlock == 0 && !resume {
 			log.Errorf("Begin block is required")
 			return
 		}
+		if beginBlock != 0 && resume {
+			log.Errorf("--begin-block and --resume are mutually exclusive")
+			return
+		}
+		stateFile, _ := cmd.Flags().GetString(StateFileFlag)
+		if stateFile == "" && resume {
+			log.Errorf("--resume requires --state-file")
+			return
+		}
+		overwrite, _ := cmd.Flags().GetBool(OverwriteFlag)
+		if overwrite && resume {
+			log.Errorf("--overwrite-state and --resume are mutually exclusive")
+			return
+		}
+		if _, err := os.Stat(stateFile); stateFile != "" && !resume && !overwrite && err == nil {
+			log.Errorf("%s holds the progress of a previous fetch, use --resume to continue it or --overwrite-state to start over", stateFile)
+			return
+		}
+		endBlockStr, _ := cmd.Flags().GetString(EndBlockFlag)
+		endBlock, err := parseBlockSpec(endBlockStr)
+		if err != nil {
+			log.WithError(err).Error("Invalid --end-block")
+			return
+		}
+		if !endBlock.isTag() && endBlock.number < beginBlock {
+			log.Errorf("--end-block (%d) < --begin-block (%d)", endBlock.number, beginBlock)
+			return
+		}
+		follow, _ := cmd.Flags().GetBool(FollowFlag)
+		confirmations, _ := cmd.Flags().GetUint64(ConfirmationsFlag)
+		pollInterval, _ := cmd.Flags().GetDuration(PollIntervalFlag)
+		if follow && pollInterval <= 0 {
+			log.Errorf("--poll-interval must be > 0")
+			return
+		}
+		// Transactions sent from a block the source later reorgs away stay
+		// on the target, so --follow must keep away from the latest head.
+		if follow && confirmations == 0 && endBlock.tag != "finalized" && endBlock.tag != "safe" {
+			log.Errorf("--follow requires --confirmations > 0 or --end-block finalized|safe")
+			return
+		}
 		txBatchSize, _ := cmd.Flags().GetUint64(TxBatchSizeFlag)
-		doFetch(fetchUrl, targetUrl, beginBlock, txBatchSize)
+		doFetch(cmd.Context(), fetchUrl, targetUrl, fetchOptions{
+			beginBlock:    beginBlock,
+			endBlock:      endBlock,
+			follow:        follow,
+			confirmations: confirmations,
+			pollInterval:  pollInterval,
+			txBatchSize:   txBatchSize,
+			stateFile:     stateFile,
+			resume:        resume,
+		})
 	},
 }
 
+// TxInfo is a source transaction with its position. fetchTx also sends
+// TxInfos without tx, meaning that every block before originBlock has been
+// handed over and it is waiting for new blocks.
 type TxInfo struct {
 	originBlock uint64
 	idx         int
 	tx          *types.Transaction
 }
 
-func fetchTx(sourceClient *ethclient.Client, beginBlock uint64, endBlock uint64, txsCh chan TxInfo) error {
-	ctx := context.Background()
-	for currentBlock := beginBlock; currentBlock < endBlock; {
+// fetchStats counts what a fetch run did, for the summary printed when it
+// ends or is interrupted.
+type fetchStats struct {
+	beginBlock  uint64
+	lastBlock   uint64 // last source block read, beginBlock-1 before the first
+	fetched     int    // transactions read from the source
+	sent        int    // transactions accepted by the target
+	failed      int    // transactions the target rejected for good
+	mined       int    // sent transactions with a receipt on the target
+	dropped     int    // fetched transactions never sent because of a shutdown
+	unconfirmed []TxInfo
+}
+
+func (s *fetchStats) log() {
+	log.Infof("fetch summary: blocks=%d..%d fetched=%d sent=%d failed=%d mined=%d unconfirmed=%d not sent=%d",
+		s.beginBlock, s.lastBlock, s.fetched, s.sent, s.failed, s.mined, len(s.unconfirmed), s.dropped)
+	for _, info := range s.unconfirmed {
+		log.Warnf("Transaction %d:%s was sent but not confirmed", info.originBlock, info.tx.Hash().Hex())
+	}
+}
+
+// fetchTx sends the transactions of blocks [beginBlock, endBlock] on txsCh,
+// starting at transaction beginIdx of beginBlock. Only blocks up to the
+// source head of opts.endBlock, less opts.confirmations, are read; with
+// opts.follow it then waits for the head to advance instead of stopping,
+// and an endBlock of math.MaxUint64 means no end. txsCh is closed when
+// done or when ctx is done. lastBlock is set to each block after its
+// transactions have been handed over.
+func fetchTx(ctx context.Context, sourceClient *ethclient.Client, beginBlock uint64, beginIdx int, endBlock uint64, opts fetchOptions, txsCh chan TxInfo, lastBlock *uint64) error {
+	defer close(txsCh)
+	headSpec := opts.endBlock
+	if !headSpec.isTag() {
+		headSpec = blockSpec{tag: "latest"}
+	}
+	var available uint64
+	for currentBlock := beginBlock; currentBlock <= endBlock; {
+		if currentBlock > available || available == 0 {
+			head, err := headSpec.resolve(ctx, sourceClient, opts.confirmations)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				log.Errorf("Failed to get the %s block number from source chain: %s", headSpec, err)
+				select {
+				case <-time.After(1 * time.Second):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				continue
+			}
+			available = head
+			if currentBlock > available {
+				if !opts.follow {
+					return nil
+				}
+				select {
+				case txsCh <- TxInfo{originBlock: currentBlock}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				log.Debugf("Waiting for block %d, the source is at %d", currentBlock, available)
+				select {
+				case <-time.After(opts.pollInterval):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				continue
+			}
+		}
+
 		// Fetch block from source
 		block, err := sourceClient.BlockByNumber(ctx, big.NewInt(int64(currentBlock)))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if err != nil {
 			log.Errorf("Failed to fetch block %d: %s", currentBlock, err)
-			time.Sleep(1 * time.Second)
+			select {
+			case <-time.After(1 * time.Second):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 			continue
 		}
 		txs := block.Transactions()
+		if currentBlock == beginBlock && beginIdx > 0 {
+			if beginIdx > len(txs) {
+				beginIdx = len(txs)
+			}
+			txs = txs[beginIdx:]
+		} else {
+			beginIdx = 0
+		}
 		if len(txs) == 0 {
+			*lastBlock = currentBlock
 			currentBlock++
 			continue
 		}
 
-		log.Infof("Processing block %d with %d transactions, remain block %d.", currentBlock, len(block.Transactions()), endBlock-currentBlock)
+		remain := available
+		if endBlock < remain {
+			remain = endBlock
+		}
+		log.Infof("Processing block %d with %d transactions, remain block %d.", currentBlock, len(block.Transactions()), remain-currentBlock)
 
 		for i, tx := range txs {
-			txsCh <- TxInfo{
+			select {
+			case txsCh <- TxInfo{
 				originBlock: block.Number().Uint64(),
-				idx:         i,
+				idx:         beginIdx + i,
 				tx:          tx,
+			}:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 		}
+		*lastBlock = currentBlock
 		currentBlock++
 		time.Sleep(50 * time.Millisecond)
 	}
-	close(txsCh)
 	return nil
 }
 
-func batchBroadCast(targetClient *ethclient.Client, batch []TxInfo) error {
-	ctx := context.Background()
+// batchBroadCast sends a batch to the target and waits for the receipts.
+// Transactions in onTarget are already mined there and are not sent again.
+// Once ctx is done nothing more is sent, and the transactions still waiting
+// for a receipt are returned as unconfirmed. settled is the number of
+// leading transactions of the batch that are mined or were rejected for
+// good; a transaction the target was unavailable for is never settled, so
+// it stays in flight and a resumed run sends it again.
+func batchBroadCast(ctx context.Context, targetClient *ethclient.Client, batch []TxInfo, onTarget map[common.Hash]bool, stats *fetchStats) (settled int, unconfirmed []TxInfo) {
 	wg := sync.WaitGroup{}
-	wait := make([]TxInfo, 0)
-	for _, txInfo := range batch {
-		err := targetClient.SendTransaction(ctx, txInfo.tx)
+	done := make([]bool, len(batch))
+	wait := make([]int, 0)
+	for i, txInfo := range batch {
+		if ctx.Err() != nil {
+			stats.dropped += len(batch) - i
+			break
+		}
+		if onTarget[txInfo.tx.Hash()] {
+			log.Infof("Transaction %d:%s already mined on target", txInfo.originBlock, txInfo.tx.Hash().Hex())
+			done[i] = true
+			stats.mined++
+			continue
+		}
+		err := sendTransaction(ctx, targetClient, txInfo)
 		if err != nil {
-			log.Errorf("Failed to send transaction %s: %s", txInfo.tx.Hash().Hex(), err)
+			if ctx.Err() != nil {
+				stats.dropped += len(batch) - i
+				break
+			}
+			stats.failed++
+			if errors.Is(err, errSendAttempts) {
+				// Not settled: a resumed run sends it again.
+				log.Errorf("Gave up sending transaction %d:%s: %s", txInfo.originBlock, txInfo.tx.Hash().Hex(), err)
+				continue
+			}
+			log.Errorf("Target rejected transaction %d:%s: %s", txInfo.originBlock, txInfo.tx.Hash().Hex(), err)
+			done[i] = true
 			continue
 		}
-		wait = append(wait, txInfo)
+		stats.sent++
+		wait = append(wait, i)
 	}
-	for _, txInfo := range wait {
+	for _, i := range wait {
 		wg.Add(1)
-		go func(info TxInfo) {
+		go func(i int, info TxInfo) {
 			defer wg.Done()
 			receipt, err := targetClient.TransactionReceipt(ctx, info.tx.Hash())
 			for err != nil || receipt == nil {
-				time.Sleep(1 * time.Second)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(1 * time.Second):
+				}
 				receipt, err = targetClient.TransactionReceipt(ctx, info.tx.Hash())
 			}
-			if err != nil {
-				log.Errorf("Failed to get receipt for transaction %d:%s: %s", info.originBlock, info.tx.Hash().Hex(), err)
-				return
-			}
+			done[i] = true
 			log.Infof("Transaction %d:%s mined in block %d", info.originBlock, info.tx.Hash().Hex(), receipt.BlockNumber.Uint64())
-		}(txInfo)
+		}(i, batch[i])
 	}
 	wg.Wait()
+	for _, i := range wait {
+		if done[i] {
+			stats.mined++
+		} else {
+			unconfirmed = append(unconfirmed, batch[i])
+		}
+	}
+	for settled < len(batch) && done[settled] {
+		settled++
+	}
+	return settled, unconfirmed
+}
 
-	return nil
+// Bounds of the delay between attempts to send a transaction while the
+// target is unavailable, and the number of attempts before giving up on it.
+var (
+	minSendRetryDelay = 1 * time.Second
+	maxSendRetryDelay = 30 * time.Second
+	maxSendAttempts   = 10
+)
+
+// errSendAttempts is returned by sendTransaction when the target was
+// unavailable for every attempt.
+var errSendAttempts = errors.New("target unavailable")
+
+// rejections are the errors with which geth refuses a transaction for good.
+// Sending it again cannot succeed, so such a transaction is settled.
+var rejections = []string{
+	"nonce too low",
+	"invalid sender",
+	"transaction type not supported",
+	"only replay-protected (eip-155) transactions allowed over rpc",
+	"replacement transaction underpriced",
+	"transaction underpriced",
+	"exceeds the configured cap",
+	"intrinsic gas too low",
+	"insufficient funds for gas * price + value",
+	"exceeds block gas limit",
+	"max priority fee per gas higher than max fee per gas",
+	"max fee per gas less than block base fee",
+	"oversized data",
+	"negative value",
+}
+
+// sendTransaction sends a transaction to the target. It returns nil once the
+// target accepted the transaction, or already knows it, and the error if the
+// target rejected it. Any other error, such as a timeout or an unavailable
+// node, is retried until ctx is done or maxSendAttempts is reached: skipping
+// the transaction would leave a nonce gap for every later one of the same
+// sender.
+func sendTransaction(ctx context.Context, targetClient *ethclient.Client, info TxInfo) error {
+	delay := minSendRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := targetClient.SendTransaction(ctx, info.tx)
+		if err == nil || strings.Contains(err.Error(), "already known") {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		for _, rejection := range rejections {
+			if strings.Contains(strings.ToLower(err.Error()), rejection) {
+				return err
+			}
+		}
+		if attempt == maxSendAttempts {
+			return fmt.Errorf("%w after %d attempts: %s", errSendAttempts, attempt, err)
+		}
+		log.Warnf("Failed to send transaction %d:%s, retrying in %s: %s", info.originBlock, info.tx.Hash().Hex(), delay, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxSendRetryDelay {
+			delay = maxSendRetryDelay
+		}
+	}
 }
 
-func doFetch(fetchUrl, targetUrl string, beginBlock uint64, txBatchSize uint64) {
+// fetchOptions are the range and the state file of the fetch command.
+type fetchOptions struct {
+	beginBlock    uint64
+	endBlock      blockSpec // inclusive; a tag is resolved on the source
+	follow        bool      // keep mirroring new source blocks
+	confirmations uint64    // stay this many blocks behind the source head
+	pollInterval  time.Duration
+	txBatchSize   uint64
+	stateFile     string // empty to keep no state
+	resume        bool   // continue from stateFile instead of beginBlock
+}
+
+func doFetch(ctx context.Context, fetchUrl, targetUrl string, opts fetchOptions) {
 	// Connect to source chain
-	sourceClient, err := ethclient.Dial(fetchUrl)
+	sourceClient, err := ethclient.DialContext(ctx, fetchUrl)
 	if err != nil {
 		log.Errorf("Failed to connect to source chain: %s", err)
 		return
 	}
 	defer sourceClient.Close()
 
-	endBlock, err := sourceClient.BlockNumber(context.Background())
+	// Connect to target chain
+	targetClient, err := ethclient.DialContext(ctx, targetUrl)
 	if err != nil {
-		log.Errorf("Failed to get latest block number from source chain: %s", err)
+		log.Errorf("Failed to connect to target chain: %s", err)
 		return
 	}
+	defer targetClient.Close()
 
-	if endBlock < beginBlock {
-		log.Errorf("end block %d < begin block %d", endBlock, beginBlock)
+	state, err := openFetchState(ctx, sourceClient, targetClient, opts)
+	if err != nil {
+		log.Errorf("Failed to set up the fetch state: %s", err)
 		return
 	}
+	beginBlock, beginIdx := state.Block, state.Index+1
 
-	// Connect to target chain
-	targetClient, err := ethclient.Dial(targetUrl)
-	if err != nil {
-		log.Errorf("Failed to connect to target chain: %s", err)
+	// Without --follow the range ends at the source head of now. A tag
+	// while following has no end.
+	var endBlock uint64 = math.MaxUint64
+	if !opts.endBlock.isTag() {
+		endBlock = opts.endBlock.number
+	}
+	if !opts.follow {
+		headSpec := opts.endBlock
+		if !headSpec.isTag() {
+			headSpec = blockSpec{tag: "latest"}
+		}
+		head, err := headSpec.resolve(ctx, sourceClient, opts.confirmations)
+		if err != nil {
+			log.Errorf("Failed to get %s block number from source chain: %s", headSpec, err)
+			return
+		}
+		if endBlock == math.MaxUint64 {
+			endBlock = head
+		} else if endBlock > head {
+			log.Errorf("end block %d is beyond the source head %d, use --follow to wait for it", endBlock, head)
+			return
+		}
+	}
+
+	if endBlock < beginBlock {
+		log.Errorf("end block %d < begin block %d", endBlock, beginBlock)
 		return
 	}
-	defer targetClient.Close()
+	if opts.follow && endBlock == math.MaxUint64 {
+		log.Infof("Following the %s source head with %d confirmations", opts.endBlock, opts.confirmations)
+	} else if opts.follow {
+		log.Infof("Following the source up to block %d with %d confirmations", endBlock, opts.confirmations)
+	}
+
+	stats := &fetchStats{beginBlock: beginBlock, lastBlock: beginBlock - 1}
+	defer stats.log()
 
 	txCh := make(chan TxInfo, 1000)
-	go fetchTx(sourceClient, beginBlock, endBlock, txCh)
-	maxBatchSize := int(txBatchSize)
+	go fetchTx(ctx, sourceClient, beginBlock, beginIdx, endBlock, opts, txCh, &stats.lastBlock)
+	maxBatchSize := int(opts.txBatchSize)
 
 	batch := make([]TxInfo, 0, maxBatchSize)
+	// complete stays true while every transaction read so far is settled,
+	// which lets the state move past the blocks without transactions.
+	complete := true
+	broadcast := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := state.inFlight(batch); err != nil {
+			log.Errorf("Failed to save fetch state: %s", err)
+		}
+		settled, unconfirmed := batchBroadCast(ctx, targetClient, batch, state.mined, stats)
+		stats.unconfirmed = append(stats.unconfirmed, unconfirmed...)
+		complete = complete && settled == len(batch)
+		if err := state.settle(batch, settled); err != nil {
+			log.Errorf("Failed to save fetch state: %s", err)
+		}
+		batch = batch[:0]
+	}
 
-	finish := false
-	for !finish {
-		select {
-		case tx, ok := <-txCh:
-			if !ok {
-				finish = true
-				break
+	// The channel is read until fetchTx closes it, so that stats.lastBlock
+	// is final afterwards. Once ctx is done the rest is only counted.
+	for tx := range txCh {
+		if tx.tx == nil {
+			// fetchTx caught up with the source, so the partial batch
+			// would otherwise wait for the next transactions.
+			if ctx.Err() == nil {
+				broadcast()
 			}
-			batch = append(batch, tx)
-			if len(batch) >= maxBatchSize {
-				err := batchBroadCast(targetClient, batch)
-				if err != nil {
-					log.Errorf("Failed to broadcast batch: %s", err)
+			if complete && ctx.Err() == nil && tx.originBlock > state.Block {
+				if err := state.advance(tx.originBlock); err != nil {
+					log.Errorf("Failed to save fetch state: %s", err)
 				}
-				batch = batch[:0]
 			}
+			continue
+		}
+		stats.fetched++
+		if ctx.Err() != nil {
+			stats.dropped++
+			complete = false
+			continue
+		}
+		batch = append(batch, tx)
+		if len(batch) >= maxBatchSize {
+			broadcast()
 		}
 	}
-	if err := batchBroadCast(targetClient, batch); err != nil {
-		log.Errorf("Failed to broadcast final batch: %s", err)
+	broadcast()
+	if complete && stats.lastBlock+1 > beginBlock {
+		if err := state.advance(stats.lastBlock + 1); err != nil {
+			log.Errorf("Failed to save fetch state: %s", err)
+		}
+	}
+	if ctx.Err() != nil && opts.follow {
+		log.Infof("Stopped following at block %d.", stats.lastBlock+1)
+	} else if ctx.Err() != nil {
+		log.Warnf("Fetch interrupted at block %d.", stats.lastBlock+1)
 	} else {
 		log.Infof("Successfully fetched all transactions.")
 	}
+	if opts.stateFile != "" {
+		log.Infof("Fetch state saved to %s: --resume starts at %s with %d transactions in flight", opts.stateFile, state.next(), len(state.Pending))
+	}
 	return
 }
 
 func init() {
 	fetchCmd.Flags().String(FetchUrlFlag, "", "URL of the source chain to fetch from")
 	fetchCmd.Flags().String(TargetUrlFlag, "", "URL of the target chain to send to")
-	fetchCmd.Flags().Uint64(BeginBlockFlag, 0, "Block number to start fetching from")
+	fetchCmd.Flags().Uint64(BeginBlockFlag, 0, "Block number to start fetching from (not with --resume)")
+	fetchCmd.Flags().String(EndBlockFlag, "0", "Last block (inclusive) to fetch: a block number or latest|finalized|safe. 0 means latest")
+	fetchCmd.Flags().Bool(FollowFlag, false, "Keep mirroring new source blocks as they arrive, up to --end-block if it is a number; requires --confirmations or --end-block finalized|safe")
+	fetchCmd.Flags().Uint64(ConfirmationsFlag, 0, "Stay this many blocks behind the latest/finalized/safe source head")
+	fetchCmd.Flags().Duration(PollIntervalFlag, 5*time.Second, "How often to check the source head with --follow")
 	fetchCmd.Flags().Uint64(TxBatchSizeFlag, 20, "Number of transactions to batch before sending")
+	fetchCmd.Flags().String(StateFileFlag, "", "File where the progress is saved after every batch, to continue it with --resume")
+	fetchCmd.Flags().Bool(ResumeFlag, false, "Continue from the progress saved in --state-file instead of --begin-block")
+	fetchCmd.Flags().Bool(OverwriteFlag, false, "Start over at --begin-block even if --state-file holds the progress of a previous fetch")
 	fetchCmd.MarkFlagRequired(FetchUrlFlag)
 	fetchCmd.MarkFlagRequired(TargetUrlFlag)
-	fetchCmd.MarkFlagRequired(BeginBlockFlag)
 
 	rootCmd.AddCommand(fetchCmd)
 }
@@ -0,0 +1,243 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+const testChainID = 1337
+
+// testChain serves the eth_ methods fetch uses on the source and the target.
+// Sent transactions are mined right away.
+type testChain struct {
+	blocks []*types.Block
+
+	mu       sync.Mutex
+	sendErrs []string // errors of the next sends, "" for none
+	down     bool     // fail every send as unavailable
+	mined    map[common.Hash]bool
+}
+
+// newTestChain returns a chain of n blocks, block i with txs(i) transfers
+// signed by one key.
+func newTestChain(n int, txs func(i int) int) *testChain {
+	key, _ := crypto.GenerateKey()
+	signer := types.LatestSignerForChainID(big.NewInt(testChainID))
+	c := &testChain{mined: make(map[common.Hash]bool)}
+	var nonce uint64
+	var parent common.Hash
+	for i := 0; i < n; i++ {
+		var list []*types.Transaction
+		for j := 0; j < txs(i); j++ {
+			tx, _ := types.SignNewTx(key, signer, &types.LegacyTx{Nonce: nonce, Gas: 21000, GasPrice: big.NewInt(1), To: &common.Address{1}, Value: big.NewInt(1)})
+			list = append(list, tx)
+			nonce++
+		}
+		header := &types.Header{ParentHash: parent, Number: big.NewInt(int64(i)), GasLimit: 30000000, Time: uint64(1000 + i), Difficulty: new(big.Int)}
+		block := types.NewBlock(header, list, nil, nil, trie.NewStackTrie(nil))
+		c.blocks = append(c.blocks, block)
+		parent = block.Hash()
+	}
+	return c
+}
+
+func (c *testChain) ChainId() hexutil.Uint64 { return testChainID }
+
+func (c *testChain) BlockNumber() hexutil.Uint64 { return hexutil.Uint64(len(c.blocks) - 1) }
+
+func (c *testChain) GetBlockByNumber(n rpc.BlockNumber, full bool) (map[string]interface{}, error) {
+	i := int(n)
+	if n < 0 {
+		i = len(c.blocks) - 1
+	}
+	if i >= len(c.blocks) {
+		return nil, nil
+	}
+	return marshalBlock(c.blocks[i])
+}
+
+// marshalBlock returns b as eth_getBlockByNumber returns it with full
+// transactions.
+func marshalBlock(b *types.Block) (map[string]interface{}, error) {
+	res := make(map[string]interface{})
+	if err := remarshal(b.Header(), &res); err != nil {
+		return nil, err
+	}
+	txs := []interface{}{}
+	for _, tx := range b.Transactions() {
+		m := make(map[string]interface{})
+		if err := remarshal(tx, &m); err != nil {
+			return nil, err
+		}
+		m["blockHash"], m["blockNumber"] = b.Hash(), hexutil.Uint64(b.NumberU64())
+		txs = append(txs, m)
+	}
+	res["transactions"], res["uncles"] = txs, []common.Hash{}
+	return res, nil
+}
+
+func (c *testChain) SendRawTransaction(raw hexutil.Bytes) (common.Hash, error) {
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(raw); err != nil {
+		return common.Hash{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down {
+		return common.Hash{}, errors.New("502 bad gateway")
+	}
+	if len(c.sendErrs) > 0 {
+		msg := c.sendErrs[0]
+		c.sendErrs = c.sendErrs[1:]
+		if msg == "already known" {
+			// It is in the pool of the target and gets mined anyway.
+			c.mined[tx.Hash()] = true
+		}
+		if msg != "" {
+			return common.Hash{}, errors.New(msg)
+		}
+	}
+	c.mined[tx.Hash()] = true
+	return tx.Hash(), nil
+}
+
+func (c *testChain) GetTransactionReceipt(hash common.Hash) (map[string]interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.mined[hash] {
+		return nil, nil
+	}
+	res := make(map[string]interface{})
+	err := remarshal(&types.Receipt{Status: types.ReceiptStatusSuccessful, TxHash: hash, BlockNumber: big.NewInt(1), Logs: []*types.Log{}}, &res)
+	return res, err
+}
+
+func remarshal(v interface{}, to interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+// batchOf returns the transactions of the given blocks as a batch.
+func (c *testChain) batchOf(blocks ...int) []TxInfo {
+	var batch []TxInfo
+	for _, n := range blocks {
+		for i, tx := range c.blocks[n].Transactions() {
+			batch = append(batch, TxInfo{originBlock: uint64(n), idx: i, tx: tx})
+		}
+	}
+	return batch
+}
+
+func TestFetchTxResumeIndex(t *testing.T) {
+	source := newTestChain(5, func(int) int { return 3 })
+	c := newTestClient(t, source)
+	tests := []struct {
+		beginBlock, endBlock uint64
+		beginIdx             int
+		want                 [][2]int // block, index
+	}{
+		{beginBlock: 2, endBlock: 3, beginIdx: 0, want: [][2]int{{2, 0}, {2, 1}, {2, 2}, {3, 0}, {3, 1}, {3, 2}}},
+		{beginBlock: 2, endBlock: 3, beginIdx: 1, want: [][2]int{{2, 1}, {2, 2}, {3, 0}, {3, 1}, {3, 2}}},
+		{beginBlock: 2, endBlock: 3, beginIdx: 3, want: [][2]int{{3, 0}, {3, 1}, {3, 2}}},
+		{beginBlock: 2, endBlock: 3, beginIdx: 7, want: [][2]int{{3, 0}, {3, 1}, {3, 2}}},
+		{beginBlock: 4, endBlock: 4, beginIdx: 2, want: [][2]int{{4, 2}}},
+		// Beyond the source head without --follow nothing is read.
+		{beginBlock: 5, endBlock: 9},
+	}
+	for _, tt := range tests {
+		txsCh := make(chan TxInfo, 100)
+		var lastBlock uint64
+		opts := fetchOptions{endBlock: blockSpec{number: tt.endBlock}}
+		if err := fetchTx(context.Background(), c, tt.beginBlock, tt.beginIdx, tt.endBlock, opts, txsCh, &lastBlock); err != nil {
+			t.Fatal(err)
+		}
+		var got [][2]int
+		for info := range txsCh {
+			if info.tx.Hash() != source.blocks[info.originBlock].Transactions()[info.idx].Hash() {
+				t.Errorf("transaction %d:%d is not the one of the source", info.originBlock, info.idx)
+			}
+			got = append(got, [2]int{int(info.originBlock), info.idx})
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("fetchTx(%d:%d..%d) sent %v, want %v", tt.beginBlock, tt.beginIdx, tt.endBlock, got, tt.want)
+		}
+		if tt.want != nil && lastBlock != tt.endBlock {
+			t.Errorf("fetchTx(%d:%d..%d) stopped at block %d", tt.beginBlock, tt.beginIdx, tt.endBlock, lastBlock)
+		}
+	}
+}
+
+func TestBatchBroadCast(t *testing.T) {
+	minDelay, maxDelay, attempts := minSendRetryDelay, maxSendRetryDelay, maxSendAttempts
+	minSendRetryDelay, maxSendRetryDelay, maxSendAttempts = 10*time.Millisecond, 10*time.Millisecond, 3
+	defer func() { minSendRetryDelay, maxSendRetryDelay, maxSendAttempts = minDelay, maxDelay, attempts }()
+
+	source := newTestChain(2, func(int) int { return 3 })
+	batch := source.batchOf(1)
+	tests := []struct {
+		name        string
+		sendErrs    []string
+		down        bool
+		interrupted bool
+		onTarget    []int // indices of the batch already mined on the target
+		settled     int
+		stats       fetchStats
+		unconfirmed int
+	}{
+		{name: "all sent", settled: 3, stats: fetchStats{sent: 3, mined: 3}},
+		{name: "already known", sendErrs: []string{"", "already known"}, settled: 3, stats: fetchStats{sent: 3, mined: 3}},
+		{name: "already mined", onTarget: []int{0, 2}, settled: 3, stats: fetchStats{sent: 1, mined: 3}},
+		{name: "rejected", sendErrs: []string{"", "nonce too low"}, settled: 3, stats: fetchStats{sent: 2, failed: 1, mined: 2}},
+		{name: "invalid sender", sendErrs: []string{"invalid sender"}, settled: 3, stats: fetchStats{sent: 2, failed: 1, mined: 2}},
+		{name: "not replay-protected", sendErrs: []string{"only replay-protected (EIP-155) transactions allowed over RPC"}, settled: 3, stats: fetchStats{sent: 2, failed: 1, mined: 2}},
+		{name: "type not supported", sendErrs: []string{"transaction type not supported"}, settled: 3, stats: fetchStats{sent: 2, failed: 1, mined: 2}},
+		{name: "underpriced replacement", sendErrs: []string{"replacement transaction underpriced"}, settled: 3, stats: fetchStats{sent: 2, failed: 1, mined: 2}},
+		{name: "fee cap", sendErrs: []string{"tx fee (1.50 ether) exceeds the configured cap (1.00 ether)"}, settled: 3, stats: fetchStats{sent: 2, failed: 1, mined: 2}},
+		{name: "transient error", sendErrs: []string{"", "connection refused"}, settled: 3, stats: fetchStats{sent: 3, mined: 3}},
+		{name: "html error page", sendErrs: []string{"invalid character '<' looking for beginning of value"}, settled: 3, stats: fetchStats{sent: 3, mined: 3}},
+		{name: "gave up", sendErrs: []string{"", "timeout", "timeout", "timeout"}, settled: 1, stats: fetchStats{sent: 2, failed: 1, mined: 2}},
+		{name: "target down", down: true, settled: 0, stats: fetchStats{failed: 3}},
+		{name: "interrupted", down: true, interrupted: true, settled: 0, stats: fetchStats{dropped: 3}},
+	}
+	for _, tt := range tests {
+		target := &testChain{mined: make(map[common.Hash]bool), sendErrs: tt.sendErrs, down: tt.down}
+		onTarget := make(map[common.Hash]bool)
+		for _, i := range tt.onTarget {
+			onTarget[batch[i].tx.Hash()] = true
+			target.mined[batch[i].tx.Hash()] = true
+		}
+		client := newTestClient(t, target)
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		if tt.interrupted {
+			cancel()
+		}
+		var stats fetchStats
+		settled, unconfirmed := batchBroadCast(ctx, client, batch, onTarget, &stats)
+		cancel()
+		if settled != tt.settled {
+			t.Errorf("%s: settled %d, want %d", tt.name, settled, tt.settled)
+		}
+		if !reflect.DeepEqual(stats, tt.stats) {
+			t.Errorf("%s: stats %+v, want %+v", tt.name, stats, tt.stats)
+		}
+		if len(unconfirmed) != tt.unconfirmed {
+			t.Errorf("%s: %d unconfirmed, want %d", tt.name, len(unconfirmed), tt.unconfirmed)
+		}
+	}
+}
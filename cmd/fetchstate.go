@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+)
+
+// fetchStateVersion is the version of the fetch state file format. Files
+// with a different version are not resumed.
+const fetchStateVersion = 1
+
+// fetchState is the progress of a fetch run, saved to the state file before
+// and after every batch. Every source transaction up to and including
+// transaction Index of block Block is settled on the target: mined, or
+// rejected by it for good. An Index of -1 means that none of Block's transactions
+// are. Pending are the transactions after that position that were, or were
+// about to be, sent without a receipt yet.
+type fetchState struct {
+	Version     int              `json:"version"`
+	ChainID     *big.Int         `json:"chainId"`     // of the source
+	GenesisHash common.Hash      `json:"genesisHash"` // of the source
+	Block       uint64           `json:"block"`
+	Index       int              `json:"index"`
+	Pending     []fetchPendingTx `json:"pending"`
+
+	path  string
+	mined map[common.Hash]bool // pending transactions of the resumed run found mined on the target
+}
+
+type fetchPendingTx struct {
+	Block uint64      `json:"block"`
+	Index int         `json:"index"`
+	Hash  common.Hash `json:"hash"`
+}
+
+// openFetchState starts a new state at opts.beginBlock or, with
+// opts.resume, loads the state file and checks the transactions the
+// previous run left in flight on the target.
+func openFetchState(ctx context.Context, sourceClient, targetClient *ethclient.Client, opts fetchOptions) (*fetchState, error) {
+	chainID, genesis, err := chainIdentity(ctx, sourceClient)
+	if err != nil {
+		return nil, fmt.Errorf("source identity: %w", err)
+	}
+	if !opts.resume {
+		s := &fetchState{
+			Version:     fetchStateVersion,
+			ChainID:     chainID,
+			GenesisHash: genesis,
+			Block:       opts.beginBlock,
+			Index:       -1,
+			path:        opts.stateFile,
+		}
+		return s, s.save()
+	}
+
+	data, err := os.ReadFile(opts.stateFile)
+	if err != nil {
+		return nil, err
+	}
+	s := &fetchState{path: opts.stateFile}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", opts.stateFile, err)
+	}
+	if s.Version != fetchStateVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d, want %d", opts.stateFile, s.Version, fetchStateVersion)
+	}
+	if s.ChainID == nil || s.ChainID.Cmp(chainID) != 0 || s.GenesisHash != genesis {
+		return nil, fmt.Errorf("%s was written for chain %v (genesis %s), the source is chain %v (genesis %s)",
+			opts.stateFile, s.ChainID, s.GenesisHash.Hex(), chainID, genesis.Hex())
+	}
+
+	// Transactions already mined are skipped when the source is read again,
+	// the others are sent again.
+	s.mined = make(map[common.Hash]bool)
+	for _, p := range s.Pending {
+		receipt, err := targetClient.TransactionReceipt(ctx, p.Hash)
+		if errors.Is(err, ethereum.NotFound) || (err == nil && receipt == nil) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("receipt of in-flight transaction %s: %w", p.Hash.Hex(), err)
+		}
+		s.mined[p.Hash] = true
+	}
+	log.Infof("Resuming at %s: %d transactions in flight, %d of them mined since",
+		s.next(), len(s.Pending), len(s.mined))
+	return s, nil
+}
+
+// next describes where a resumed run starts.
+func (s *fetchState) next() string {
+	if s.Index < 0 {
+		return fmt.Sprintf("block %d", s.Block)
+	}
+	return fmt.Sprintf("block %d tx %d", s.Block, s.Index+1)
+}
+
+// inFlight records batch as about to be sent.
+func (s *fetchState) inFlight(batch []TxInfo) error {
+	s.Pending = s.Pending[:0]
+	for _, info := range batch {
+		s.Pending = append(s.Pending, fetchPendingTx{Block: info.originBlock, Index: info.idx, Hash: info.tx.Hash()})
+	}
+	return s.save()
+}
+
+// settle moves the position to the last of the settled leading
+// transactions of batch. The rest of the batch stays in flight, as some of
+// it may have been mined after all.
+func (s *fetchState) settle(batch []TxInfo, settled int) error {
+	if settled > 0 {
+		last := batch[settled-1]
+		s.Block, s.Index = last.originBlock, last.idx
+	}
+	return s.inFlight(batch[settled:])
+}
+
+// advance moves the position to the start of block, once every
+// transaction before it is settled.
+func (s *fetchState) advance(block uint64) error {
+	s.Block, s.Index = block, -1
+	s.Pending = s.Pending[:0]
+	return s.save()
+}
+
+// save writes the state through a temporary file, so that a crash never
+// leaves a truncated state behind.
+func (s *fetchState) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
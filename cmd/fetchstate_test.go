@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestFetchStateProgress(t *testing.T) {
+	source := newTestChain(4, func(i int) int { return i })
+	b2, b3 := source.batchOf(2), source.batchOf(3)
+	path := filepath.Join(t.TempDir(), "fetch.json")
+	s := &fetchState{Version: fetchStateVersion, ChainID: big.NewInt(testChainID), Block: 2, Index: -1, path: path}
+	steps := []struct {
+		name    string
+		do      func() error
+		block   uint64
+		index   int
+		pending []TxInfo
+		next    string
+	}{
+		{name: "start", do: s.save, block: 2, index: -1, next: "block 2"},
+		{name: "in flight", do: func() error { return s.inFlight(append(b2, b3...)) }, block: 2, index: -1, pending: append(b2, b3...), next: "block 2"},
+		{name: "nothing settled", do: func() error { return s.settle(append(b2, b3...), 0) }, block: 2, index: -1, pending: append(b2, b3...), next: "block 2"},
+		{name: "part settled", do: func() error { return s.settle(append(b2, b3...), 3) }, block: 3, index: 0, pending: b3[1:], next: "block 3 tx 1"},
+		{name: "all settled", do: func() error { return s.settle(b3[1:], 2) }, block: 3, index: 2, next: "block 3 tx 3"},
+		{name: "advance", do: func() error { return s.advance(4) }, block: 4, index: -1, next: "block 4"},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		var want []fetchPendingTx
+		for _, info := range step.pending {
+			want = append(want, fetchPendingTx{Block: info.originBlock, Index: info.idx, Hash: info.tx.Hash()})
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		saved := new(fetchState)
+		if err := json.Unmarshal(data, saved); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		for _, got := range []*fetchState{s, saved} {
+			if got.Block != step.block || got.Index != step.index {
+				t.Errorf("%s: at %d:%d, want %d:%d", step.name, got.Block, got.Index, step.block, step.index)
+			}
+			if len(got.Pending) != 0 || len(want) != 0 {
+				if !reflect.DeepEqual(got.Pending, want) {
+					t.Errorf("%s: pending %v, want %v", step.name, got.Pending, want)
+				}
+			}
+			if next := got.next(); next != step.next {
+				t.Errorf("%s: next %q, want %q", step.name, next, step.next)
+			}
+		}
+	}
+}
+
+func TestOpenFetchStateResume(t *testing.T) {
+	source := newTestChain(3, func(int) int { return 2 })
+	sourceClient := newTestClient(t, source)
+	batch := source.batchOf(1, 2)
+	saved := func(s *fetchState) *fetchState {
+		s.Version, s.ChainID, s.GenesisHash = fetchStateVersion, big.NewInt(testChainID), source.blocks[0].Hash()
+		s.Block, s.Index = 1, 0
+		for _, info := range batch[1:] {
+			s.Pending = append(s.Pending, fetchPendingTx{Block: info.originBlock, Index: info.idx, Hash: info.tx.Hash()})
+		}
+		return s
+	}
+	tests := []struct {
+		name  string
+		state *fetchState
+		mined []int // indices of batch mined on the target
+		err   string
+	}{
+		{name: "none mined", state: saved(new(fetchState))},
+		{name: "some mined", state: saved(new(fetchState)), mined: []int{1, 2}},
+		{name: "other version", state: func() *fetchState { s := saved(new(fetchState)); s.Version++; return s }(), err: "unsupported version"},
+		{name: "other chain", state: func() *fetchState { s := saved(new(fetchState)); s.ChainID = big.NewInt(1); return s }(), err: "was written for chain"},
+		{name: "other genesis", state: func() *fetchState { s := saved(new(fetchState)); s.GenesisHash = common.Hash{1}; return s }(), err: "was written for chain"},
+		{name: "no state", err: "no such file"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "fetch.json")
+		if tt.state != nil {
+			tt.state.path = path
+			if err := tt.state.save(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		target := &testChain{mined: make(map[common.Hash]bool)}
+		want := make(map[common.Hash]bool)
+		for _, i := range tt.mined {
+			target.mined[batch[i].tx.Hash()] = true
+			want[batch[i].tx.Hash()] = true
+		}
+		opts := fetchOptions{beginBlock: 9, stateFile: path, resume: true}
+		s, err := openFetchState(context.Background(), sourceClient, newTestClient(t, target), opts)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if s.Block != 1 || s.Index != 0 || len(s.Pending) != len(batch)-1 {
+			t.Errorf("%s: resumed at %d:%d with %d pending", tt.name, s.Block, s.Index, len(s.Pending))
+		}
+		if !reflect.DeepEqual(s.mined, want) {
+			t.Errorf("%s: mined %v, want %v", tt.name, s.mined, want)
+		}
+	}
+
+	// Without resume the run starts over at the begin block.
+	path := filepath.Join(t.TempDir(), "fetch.json")
+	s, err := openFetchState(context.Background(), sourceClient, nil, fetchOptions{beginBlock: 9, stateFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Block != 9 || s.Index != -1 || s.GenesisHash != source.blocks[0].Hash() {
+		t.Errorf("new state at %d:%d for genesis %s", s.Block, s.Index, s.GenesisHash.Hex())
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("new state not saved: %v", err)
+	}
+}
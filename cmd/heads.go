@@ -0,0 +1,333 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	EndpointsFlag    = "endpoints"
+	EndpointFileFlag = "endpoint-file"
+	OnceFlag         = "once"
+	StaleLagFlag     = "stale-lag"
+)
+
+// headsCmd represents the heads command
+var headsCmd = &cobra.Command{
+	Use:   "heads",
+	Short: "Show the head of many endpoints side by side and flag stale or forked ones",
+	Run: func(cmd *cobra.Command, args []string) {
+		endpoints, _ := cmd.Flags().GetStringSlice(EndpointsFlag)
+		endpointFile, _ := cmd.Flags().GetString(EndpointFileFlag)
+		pollInterval, _ := cmd.Flags().GetDuration(PollIntervalFlag)
+		once, _ := cmd.Flags().GetBool(OnceFlag)
+		staleLag, _ := cmd.Flags().GetUint64(StaleLagFlag)
+
+		if endpointFile != "" {
+			data, err := os.ReadFile(endpointFile)
+			if err != nil {
+				log.WithError(err).Error("Invalid --endpoint-file")
+				return
+			}
+			for _, line := range strings.Split(string(data), "\n") {
+				if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+					endpoints = append(endpoints, line)
+				}
+			}
+		}
+		if len(endpoints) == 0 {
+			log.Error("At least one endpoint is required (--endpoints or --endpoint-file)")
+			return
+		}
+		if pollInterval <= 0 {
+			log.Error("Poll interval must be > 0")
+			return
+		}
+
+		if err := doHeads(cmd.Context(), endpoints, pollInterval, staleLag, once); err != nil && !stopped(cmd) {
+			log.WithError(err).Error("heads failed")
+			return
+		}
+	},
+}
+
+func init() {
+	headsCmd.Flags().StringSlice(EndpointsFlag, nil, "Endpoint URL to monitor (repeatable)")
+	headsCmd.Flags().String(EndpointFileFlag, "", "File with one endpoint URL per line")
+	headsCmd.Flags().Duration(PollIntervalFlag, 2*time.Second, "How often to refresh the table and poll the endpoints")
+	headsCmd.Flags().Bool(OnceFlag, false, "Print the table once and exit")
+	headsCmd.Flags().Uint64(StaleLagFlag, 2, "How many blocks an endpoint may trail the best head before it is marked stale")
+
+	rootCmd.AddCommand(headsCmd)
+}
+
+// endpointState is what is known about one endpoint.
+type endpointState struct {
+	name    string
+	number  uint64
+	hash    common.Hash
+	updated time.Time // when the head was last seen to change
+	syncing bool
+	peers   uint64
+	err     error
+}
+
+// headsMonitor keeps the state of every endpoint up to date.
+type headsMonitor struct {
+	interval time.Duration
+	staleLag uint64 // blocks an endpoint may trail the best head
+
+	mu     sync.Mutex
+	states []*endpointState
+}
+
+func doHeads(ctx context.Context, endpoints []string, interval time.Duration, staleLag uint64, once bool) error {
+	m := &headsMonitor{interval: interval, staleLag: staleLag}
+	var wg sync.WaitGroup
+	for _, endpoint := range endpoints {
+		st := &endpointState{name: redactURL(endpoint)}
+		m.states = append(m.states, st)
+		wg.Add(1)
+		go func(endpoint string, st *endpointState) {
+			defer wg.Done()
+			m.follow(ctx, endpoint, st, once)
+		}(endpoint, st)
+	}
+
+	if once {
+		wg.Wait()
+		m.print(os.Stdout, false)
+		return nil
+	}
+
+	clear := isTerminal(os.Stdout)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			m.print(os.Stdout, clear)
+		}
+	}
+}
+
+// follow keeps st up to date. Heads come from a subscription where the
+// endpoint supports one and are polled otherwise; the sync state and the
+// peer count are always polled.
+func (m *headsMonitor) follow(ctx context.Context, endpoint string, st *endpointState, once bool) {
+	client, err := ethclient.DialContext(ctx, endpoint)
+	if err != nil {
+		m.update(st, func() { st.err = err })
+		if once {
+			return
+		}
+		// Dial only fails for malformed URLs or unreachable websockets;
+		// keep retrying the latter.
+		for err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(m.interval):
+			}
+			client, err = ethclient.DialContext(ctx, endpoint)
+		}
+	}
+	defer client.Close()
+
+	heads := make(chan *types.Header)
+	var subErr <-chan error
+	if !once && !isHTTPEndpoint(endpoint) {
+		if sub, err := client.SubscribeNewHead(ctx, heads); err == nil {
+			defer sub.Unsubscribe()
+			subErr = sub.Err()
+		}
+	}
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		m.poll(ctx, client, st, subErr == nil)
+		if once {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-subErr:
+			log.Debugf("%s head subscription dropped, polling instead: %v", st.name, err)
+			subErr = nil
+			continue
+		case h := <-heads:
+			m.update(st, func() { st.setHead(h) })
+			continue
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *headsMonitor) poll(ctx context.Context, client *ethclient.Client, st *endpointState, pollHead bool) {
+	ctx, cancel := context.WithTimeout(ctx, m.interval)
+	defer cancel()
+
+	var head *types.Header
+	var err error
+	if pollHead {
+		head, err = client.HeaderByNumber(ctx, nil)
+	}
+	// Many providers do not serve eth_syncing or net_peerCount; the head is
+	// still worth showing without them.
+	var progress *ethereum.SyncProgress
+	var syncErr error
+	var peers uint64
+	var peersErr error
+	if err == nil {
+		progress, syncErr = client.SyncProgress(ctx)
+		peers, peersErr = client.PeerCount(ctx)
+	}
+	m.update(st, func() {
+		st.err = err
+		if err != nil {
+			return
+		}
+		if head != nil {
+			st.setHead(head)
+		}
+		if syncErr == nil {
+			st.syncing = progress != nil
+		}
+		if peersErr == nil {
+			st.peers = peers
+		}
+	})
+}
+
+func (st *endpointState) setHead(h *types.Header) {
+	if h.Hash() != st.hash {
+		st.number, st.hash, st.updated = h.Number.Uint64(), h.Hash(), time.Now()
+	}
+	st.err = nil
+}
+
+func (m *headsMonitor) update(st *endpointState, f func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f()
+}
+
+// print writes the table, the best head first. Endpoints more than staleLag
+// blocks behind are marked stale, and endpoints with a different hash than
+// the majority of the endpoints at the same height are marked forked.
+func (m *headsMonitor) print(out io.Writer, clear bool) {
+	m.mu.Lock()
+	states := make([]endpointState, len(m.states))
+	for i, st := range m.states {
+		states[i] = *st
+	}
+	m.mu.Unlock()
+
+	var best uint64
+	byHeight := make(map[uint64]map[common.Hash]int)
+	for _, st := range states {
+		if st.err != nil || st.hash == (common.Hash{}) {
+			continue
+		}
+		if st.number > best {
+			best = st.number
+		}
+		if byHeight[st.number] == nil {
+			byHeight[st.number] = make(map[common.Hash]int)
+		}
+		byHeight[st.number][st.hash]++
+	}
+	sort.SliceStable(states, func(i, j int) bool { return states[i].number > states[j].number })
+
+	if clear {
+		fmt.Fprint(out, "\033[H\033[2J")
+	}
+	fmt.Fprintf(out, "%s  best head %d\n", time.Now().Format(time.RFC3339), best)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tHEAD\tHASH\tLAG\tSYNCING\tPEERS\tAGE\tSTATUS")
+	for _, st := range states {
+		if st.err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\terror: %v\n", st.name, st.err)
+			continue
+		}
+		if st.hash == (common.Hash{}) {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\twaiting\n", st.name)
+			continue
+		}
+		lag := best - st.number
+		status := "ok"
+		switch {
+		case forked(byHeight[st.number], st.hash):
+			status = "FORKED"
+		case lag > m.staleLag:
+			status = "stale"
+		case st.syncing:
+			status = "syncing"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%v\t%d\t%s\t%s\n",
+			st.name, st.number, shortHash(st.hash), lag, st.syncing, st.peers, time.Since(st.updated).Round(time.Second), status)
+	}
+	w.Flush()
+}
+
+// forked reports whether hash is not the majority hash among the endpoints
+// at one height. Without a majority every endpoint at the height is forked.
+func forked(hashes map[common.Hash]int, hash common.Hash) bool {
+	for h, n := range hashes {
+		if h != hash && n >= hashes[hash] {
+			return true
+		}
+	}
+	return false
+}
+
+func shortHash(h common.Hash) string {
+	s := h.Hex()
+	return s[:10] + "…" + s[len(s)-4:]
+}
+
+// redactURL drops credentials and query parameters and masks the path
+// segments, which often carry API keys, of an endpoint URL. Segments of at
+// most 4 characters, such as "v3" or "rpc", are too short to be keys and
+// are kept.
+func redactURL(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return endpoint
+	}
+	u.User = nil
+	u.RawQuery = ""
+	segments := strings.Split(u.Path, "/")
+	for i, segment := range segments {
+		if len(segment) > 4 {
+			segments[i] = "***"
+		}
+	}
+	u.Path = strings.Join(segments, "/")
+	u.RawPath = u.Path
+	return u.String()
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+	log "github.com/sirupsen/logrus"
+)
+
+// Verification modes for --verify.
+const (
+	verifyNone     = ""
+	verifyBloom    = "bloom"
+	verifyReceipts = "receipts"
+)
+
+func parseVerifyMode(s string) (string, error) {
+	switch s {
+	case verifyNone, verifyBloom, verifyReceipts:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown verify mode %q: want bloom or receipts", s)
+}
+
+// verifyLogs checks the logs an endpoint returned for [from..to] against that
+// endpoint's own headers and returns the number of inconsistencies found.
+//
+// In bloom mode every returned log must be contained in its block's
+// logsBloom. In receipts mode the receipts of every block whose bloom may
+// match the filter are fetched as well, checked against the header's
+// receiptsRoot and used to find logs the endpoint left out of its answer.
+func (lc *logComparer) verifyLogs(ctx context.Context, name string, c *ethclient.Client, from, to uint64, logs []types.Log) (int, error) {
+	byBlock := make(map[uint64][]types.Log)
+	for _, l := range logs {
+		byBlock[l.BlockNumber] = append(byBlock[l.BlockNumber], l)
+	}
+
+	bad := 0
+	for number := from; number <= to; number++ {
+		blockLogs := byBlock[number]
+		if len(blockLogs) == 0 && lc.verify != verifyReceipts {
+			continue
+		}
+		header, err := c.HeaderByNumber(ctx, uint64ToBig(number))
+		if err != nil {
+			return bad, fmt.Errorf("%s header %d: %w", name, number, err)
+		}
+
+		for _, l := range blockLogs {
+			if !bloomContainsLog(header.Bloom, &l) {
+				bad++
+				log.Errorf("[%s block %d] log tx=%s index=%d is not in the header logsBloom", name, number, l.TxHash.Hex(), l.Index)
+			}
+		}
+
+		if lc.verify != verifyReceipts {
+			continue
+		}
+		if len(blockLogs) == 0 && !bloomMayMatch(header.Bloom, lc.addresses, lc.topics) {
+			continue
+		}
+		n, err := lc.verifyReceipts(ctx, name, c, header, blockLogs)
+		if err != nil {
+			return bad, err
+		}
+		bad += n
+	}
+	return bad, nil
+}
+
+// verifyReceipts rebuilds the receipts trie of the given block, compares it
+// with the header's receiptsRoot and then checks that the logs returned by
+// eth_getLogs are exactly the matching logs of those receipts.
+func (lc *logComparer) verifyReceipts(ctx context.Context, name string, c *ethclient.Client, header *types.Header, got []types.Log) (int, error) {
+	number := header.Number.Uint64()
+
+	var receipts types.Receipts
+	if err := c.Client().CallContext(ctx, &receipts, "eth_getBlockReceipts", hexutil.EncodeUint64(number)); err != nil {
+		return 0, fmt.Errorf("%s eth_getBlockReceipts %d: %w", name, number, err)
+	}
+	if root := types.DeriveSha(receipts, trie.NewStackTrie(nil)); root != header.ReceiptHash {
+		log.Errorf("[%s block %d] receipts root %s does not match header receiptsRoot %s", name, number, root.Hex(), header.ReceiptHash.Hex())
+		return 1, nil
+	}
+
+	type logKey struct {
+		tx    common.Hash
+		index uint
+	}
+	returned := make(map[logKey]bool, len(got))
+	for _, l := range got {
+		returned[logKey{l.TxHash, l.Index}] = true
+	}
+
+	bad := 0
+	expected := 0
+	for _, r := range receipts {
+		for _, l := range r.Logs {
+			if !matchesFilter(l, lc.addresses, lc.topics) {
+				continue
+			}
+			expected++
+			if !returned[logKey{l.TxHash, l.Index}] {
+				bad++
+				log.Errorf("[%s block %d] eth_getLogs is missing log tx=%s index=%d found in receipts", name, number, l.TxHash.Hex(), l.Index)
+			}
+		}
+	}
+	if len(got) != expected {
+		bad++
+		log.Errorf("[%s block %d] eth_getLogs returned %d logs, receipts contain %d matching logs", name, number, len(got), expected)
+	}
+	return bad, nil
+}
+
+func bloomContainsLog(bloom types.Bloom, l *types.Log) bool {
+	if !types.BloomLookup(bloom, l.Address) {
+		return false
+	}
+	for _, t := range l.Topics {
+		if !types.BloomLookup(bloom, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomMayMatch reports whether a block with the given bloom may contain logs
+// matching the filter. False positives are possible, false negatives are not.
+func bloomMayMatch(bloom types.Bloom, addresses []common.Address, topics [][]common.Hash) bool {
+	if len(addresses) > 0 {
+		found := false
+		for _, a := range addresses {
+			if types.BloomLookup(bloom, a) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, sub := range topics {
+		if len(sub) == 0 {
+			continue
+		}
+		found := false
+		for _, t := range sub {
+			if types.BloomLookup(bloom, t) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesFilter applies the eth_getLogs address and topic rules to l.
+func matchesFilter(l *types.Log, addresses []common.Address, topics [][]common.Hash) bool {
+	if len(addresses) > 0 {
+		found := false
+		for _, a := range addresses {
+			if a == l.Address {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(topics) > len(l.Topics) {
+		return false
+	}
+	for i, sub := range topics {
+		if len(sub) == 0 {
+			continue
+		}
+		found := false
+		for _, t := range sub {
+			if l.Topics[i] == t {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// maxHeaderBatch bounds the number of headers requested in one JSON-RPC
+// batch; many providers reject larger batches.
+const maxHeaderBatch = 100
+
+// checkLogs looks for answers no correct node gives: removed logs, the same
+// (txHash, index) pair twice, log indices that do not increase within a
+// block, and logs whose blockHash is not the canonical hash at their height.
+// c may be nil, in which case the block hashes are not checked. It returns
+// the number of anomalies found.
+func checkLogs(ctx context.Context, name string, c *ethclient.Client, logs []types.Log) (int, error) {
+	type logKey struct {
+		tx    common.Hash
+		index uint
+	}
+	bad := 0
+	seen := make(map[logKey]bool, len(logs))
+	blocks := make(map[uint64]bool)
+	var numbers []uint64
+	for i, l := range logs {
+		if l.Removed {
+			bad++
+			log.Errorf("[%s block %d] removed log returned: tx=%s index=%d", name, l.BlockNumber, l.TxHash.Hex(), l.Index)
+		}
+		key := logKey{l.TxHash, l.Index}
+		if seen[key] {
+			bad++
+			log.Errorf("[%s block %d] duplicate log: tx=%s index=%d", name, l.BlockNumber, l.TxHash.Hex(), l.Index)
+		}
+		seen[key] = true
+
+		// An exact repeat is already reported as a duplicate above.
+		if i > 0 {
+			prev := logs[i-1]
+			if prev.BlockNumber == l.BlockNumber && l.Index <= prev.Index && key != (logKey{prev.TxHash, prev.Index}) {
+				bad++
+				log.Errorf("[%s block %d] log index %d follows index %d", name, l.BlockNumber, l.Index, prev.Index)
+			}
+		}
+		if !blocks[l.BlockNumber] {
+			blocks[l.BlockNumber] = true
+			numbers = append(numbers, l.BlockNumber)
+		}
+	}
+	if c == nil || len(numbers) == 0 {
+		return bad, nil
+	}
+
+	hashes, err := canonicalHashes(ctx, c, numbers)
+	if err != nil {
+		return bad, fmt.Errorf("%s canonical hashes: %w", name, err)
+	}
+	for _, l := range logs {
+		if want := hashes[l.BlockNumber]; l.BlockHash != want {
+			bad++
+			log.Errorf("[%s block %d] log tx=%s index=%d has blockHash %s, canonical hash is %s",
+				name, l.BlockNumber, l.TxHash.Hex(), l.Index, l.BlockHash.Hex(), want.Hex())
+		}
+	}
+	return bad, nil
+}
+
+// canonicalHashes returns the hash of each of the given blocks, fetching the
+// headers in JSON-RPC batches.
+func canonicalHashes(ctx context.Context, c *ethclient.Client, numbers []uint64) (map[uint64]common.Hash, error) {
+	res := make(map[uint64]common.Hash, len(numbers))
+	for i := 0; i < len(numbers); i += maxHeaderBatch {
+		j := i + maxHeaderBatch
+		if j > len(numbers) {
+			j = len(numbers)
+		}
+		batch := make([]rpc.BatchElem, 0, j-i)
+		headers := make([]*types.Header, j-i)
+		for k, n := range numbers[i:j] {
+			batch = append(batch, rpc.BatchElem{
+				Method: "eth_getBlockByNumber",
+				Args:   []interface{}{hexutil.EncodeUint64(n), false},
+				Result: &headers[k],
+			})
+		}
+		if err := c.Client().BatchCallContext(ctx, batch); err != nil {
+			return nil, err
+		}
+		for k, elem := range batch {
+			n := numbers[i+k]
+			if elem.Error != nil {
+				return nil, fmt.Errorf("header %d: %w", n, elem.Error)
+			}
+			if headers[k] == nil {
+				return nil, fmt.Errorf("header %d: %w", n, ethereum.NotFound)
+			}
+			res[n] = headers[k].Hash()
+		}
+	}
+	return res, nil
+}
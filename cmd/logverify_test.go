@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+func TestCheckLogs(t *testing.T) {
+	// The canonical hash of a block as served by testHeads.
+	canonical := func(n uint64) common.Hash {
+		return (&types.Header{Number: new(big.Int).SetUint64(n), Difficulty: new(big.Int)}).Hash()
+	}
+	tx1, tx2 := common.HexToHash("0x01"), common.HexToHash("0x02")
+	lg := func(block uint64, tx common.Hash, index uint) types.Log {
+		return types.Log{BlockNumber: block, BlockHash: canonical(block), TxHash: tx, Index: index}
+	}
+	removed := lg(5, tx1, 0)
+	removed.Removed = true
+	forked := lg(6, tx2, 0)
+	forked.BlockHash = common.HexToHash("0xbad")
+
+	tests := []struct {
+		name string
+		logs []types.Log
+		want int
+	}{
+		{name: "none"},
+		{name: "ordered", logs: []types.Log{lg(5, tx1, 0), lg(5, tx1, 1), lg(5, tx2, 2), lg(6, tx2, 0)}},
+		{name: "removed", logs: []types.Log{removed, lg(5, tx2, 1)}, want: 1},
+		{name: "repeated", logs: []types.Log{lg(5, tx1, 0), lg(5, tx1, 0)}, want: 1},
+		{name: "duplicate", logs: []types.Log{lg(5, tx1, 0), lg(5, tx2, 1), lg(5, tx1, 0)}, want: 2},
+		{name: "misordered", logs: []types.Log{lg(5, tx1, 1), lg(5, tx2, 0)}, want: 1},
+		{name: "same index in another block", logs: []types.Log{lg(5, tx1, 3), lg(6, tx2, 0)}},
+		{name: "non-canonical", logs: []types.Log{lg(5, tx1, 0), forked}, want: 1},
+	}
+	c := newTestClient(t, &testHeads{})
+	for _, tt := range tests {
+		got, err := checkLogs(context.Background(), "test", c, tt.logs)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: %d anomalies, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// Without a client the block hashes are not checked.
+	if got, _ := checkLogs(context.Background(), "test", nil, []types.Log{forked}); got != 0 {
+		t.Errorf("without a client: %d anomalies, want 0", got)
+	}
+}
+
+func TestMatchesFilter(t *testing.T) {
+	a, b := common.HexToAddress("0x0a"), common.HexToAddress("0x0b")
+	t1, t2, t3 := common.HexToHash("0x01"), common.HexToHash("0x02"), common.HexToHash("0x03")
+	l := &types.Log{Address: a, Topics: []common.Hash{t1, t2}}
+	tests := []struct {
+		name      string
+		addresses []common.Address
+		topics    [][]common.Hash
+		want      bool
+	}{
+		{name: "no filter", want: true},
+		{name: "address", addresses: []common.Address{b, a}, want: true},
+		{name: "other address", addresses: []common.Address{b}},
+		{name: "first topic", topics: [][]common.Hash{{t1}}, want: true},
+		{name: "wildcard then topic", topics: [][]common.Hash{nil, {t3, t2}}, want: true},
+		{name: "other topic", topics: [][]common.Hash{{t1}, {t3}}},
+		{name: "more topics than the log", topics: [][]common.Hash{nil, nil, nil}},
+		{name: "address and topic", addresses: []common.Address{a}, topics: [][]common.Hash{{t2, t1}}, want: true},
+		{name: "address but not topic", addresses: []common.Address{a}, topics: [][]common.Hash{{t2}}},
+	}
+	for _, tt := range tests {
+		if got := matchesFilter(l, tt.addresses, tt.topics); got != tt.want {
+			t.Errorf("%s: matchesFilter() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
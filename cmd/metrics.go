@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/metrics/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	MetricsAddrFlag = "metrics-addr"
+)
+
+// metricsRegistry holds the metrics of the running command. Until
+// startMetrics is called the metrics package is disabled and every metric
+// is a no-op stub, so the commands can update them unconditionally.
+var metricsRegistry = metrics.NewRegistry()
+
+// startMetrics serves the metrics in Prometheus format on addr under
+// /metrics. It does nothing if addr is empty.
+func startMetrics(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	metrics.Enabled = true
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", prometheus.Handler(metricsRegistry))
+	log.Infof("Serving metrics on http://%s/metrics", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.WithError(err).Error("Metrics server stopped")
+		}
+	}()
+	return nil
+}
+
+// Metric names. Prometheus names are derived by replacing the slashes with
+// underscores.
+const (
+	headHeightMetric       = "newblock/head"
+	blockIntervalMetric    = "newblock/interval"
+	gasUtilizationMetric   = "newblock/gas/utilization"
+	reorgsMetric           = "newblock/reorgs"
+	reconnectsMetric       = "newblock/reconnects"
+	transferCountMetric    = "transfer/%s/count"
+	transferVolumeMetric   = "transfer/%s/volume"
+	compareBlockMetric     = "comparelogs/block"
+	compareMismatchMetric  = "comparelogs/mismatches"
+	compareAnomaliesMetric = "comparelogs/anomalies"
+)
+
+func gaugeMetric(name string) metrics.Gauge {
+	return metrics.GetOrRegisterGauge(name, metricsRegistry)
+}
+
+func gaugeFloat64Metric(name string) metrics.GaugeFloat64 {
+	return metrics.GetOrRegisterGaugeFloat64(name, metricsRegistry)
+}
+
+func counterMetric(name string) metrics.Counter {
+	return metrics.GetOrRegisterCounter(name, metricsRegistry)
+}
+
+func counterFloat64Metric(name string) metrics.CounterFloat64 {
+	return metrics.GetOrRegisterCounterFloat64(name, metricsRegistry)
+}
+
+func histogramMetric(name string) metrics.Histogram {
+	return metrics.GetOrRegisterHistogramLazy(name, metricsRegistry, func() metrics.Sample {
+		return metrics.NewExpDecaySample(1028, 0.015)
+	})
+}
+
+// tokenMetric returns the per-token variant of a transfer metric name.
+func tokenMetric(format string, token common.Address) string {
+	return fmt.Sprintf(format, strings.ToLower(token.Hex()))
+}
@@ -1,11 +1,14 @@
 package cmd
 
 import (
+	"context"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	. "github.com/xueqianLu/ethtools/utils"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var logLevel string
@@ -40,12 +43,34 @@ func initConfig() {
 }
 
 func Execute() {
-	if err := rootCmd.Execute(); err != nil {
+	if err := rootCmd.ExecuteContext(signalContext()); err != nil {
 		log.Errorf("Program execute error: %s", err)
 		os.Exit(1)
 	}
 }
 
+// signalContext returns a context that is cancelled on the first SIGINT or
+// SIGTERM, so that commands can stop cleanly. A second signal kills the
+// process as usual.
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs)
+		log.Infof("Received %s, shutting down. Send it again to exit immediately", sig)
+		cancel()
+	}()
+	return ctx
+}
+
+// stopped reports whether the command was asked to stop by a signal, in
+// which case the errors caused by the cancellation are not failures.
+func stopped(cmd *cobra.Command) bool {
+	return cmd.Context().Err() != nil
+}
+
 var rootCmd = &cobra.Command{
 	Use:   "ethtools",
 	Short: "A set of ethereum tools",
@@ -0,0 +1,403 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	SinkFlag                 = "sink"
+	WebhookBatchSizeFlag     = "webhook-batch-size"
+	WebhookFlushIntervalFlag = "webhook-flush-interval"
+	SpoolDirFlag             = "spool-dir"
+)
+
+// record is one event emitted by a watcher command. Records are written as
+// JSON by the machine-readable sinks and rendered with writeText by the
+// stdout text sink.
+type record interface {
+	kind() string
+	writeText(w io.Writer)
+}
+
+// sinkEnvelope is the JSON form of a record.
+type sinkEnvelope struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data record    `json:"data"`
+}
+
+// sink receives the records of a watcher command. Close flushes whatever
+// the sink still buffers.
+type sink interface {
+	emit(r record) error
+	Close() error
+}
+
+// webhookOptions configure the webhook sinks.
+type webhookOptions struct {
+	batchSize     int
+	flushInterval time.Duration
+	spoolDir      string
+}
+
+// addSinkFlags registers the output flags shared by the watcher commands.
+func addSinkFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.StringSlice(SinkFlag, []string{"stdout"}, "Output sink (repeatable): stdout, jsonl:<file> (- for stdout) or webhook:<url>")
+	flags.Int(WebhookBatchSizeFlag, 100, "Maximum number of records per webhook POST")
+	flags.Duration(WebhookFlushIntervalFlag, time.Second, "How often a partial webhook batch is sent")
+	flags.String(SpoolDirFlag, ".ethtools-spool", "Directory where webhook batches that could not be delivered are kept until they are")
+	flags.String(RulesFlag, "", "YAML file with alert rules, fired through the log and the webhook given in the file")
+}
+
+// sinkFromFlags creates the sinks selected by the flags of addSinkFlags.
+// kinds are the kinds of record cmd emits, which the alert rules are
+// checked against.
+func sinkFromFlags(cmd *cobra.Command, kinds ...string) (sink, error) {
+	specs, _ := cmd.Flags().GetStringSlice(SinkFlag)
+	batchSize, _ := cmd.Flags().GetInt(WebhookBatchSizeFlag)
+	flushInterval, _ := cmd.Flags().GetDuration(WebhookFlushIntervalFlag)
+	spoolDir, _ := cmd.Flags().GetString(SpoolDirFlag)
+	rules, _ := cmd.Flags().GetString(RulesFlag)
+	opts := webhookOptions{batchSize: batchSize, flushInterval: flushInterval, spoolDir: spoolDir}
+	out, err := newSink(specs, opts)
+	if err != nil || rules == "" {
+		return out, err
+	}
+	// Alerts are sent one by one, without waiting for a batch. They spool
+	// apart from the sinks, which may post to the same URL.
+	opts.batchSize = 1
+	opts.spoolDir = filepath.Join(spoolDir, "alerts")
+	engine, err := newAlertEngine(rules, opts, cmd.Name(), kinds)
+	if err != nil {
+		out.Close()
+		return nil, fmt.Errorf("--rules: %w", err)
+	}
+	return multiSink{out, engine}, nil
+}
+
+// newSink creates the sinks described by specs.
+func newSink(specs []string, opts webhookOptions) (sink, error) {
+	if len(specs) == 0 {
+		specs = []string{"stdout"}
+	}
+	var sinks multiSink
+	for _, spec := range specs {
+		kind, arg, _ := strings.Cut(spec, ":")
+		var (
+			s   sink
+			err error
+		)
+		switch kind {
+		case "stdout":
+			s = textSink{w: os.Stdout}
+		case "jsonl":
+			s, err = newJSONLSink(arg)
+		case "webhook":
+			s, err = newWebhookSink(arg, opts)
+		default:
+			err = fmt.Errorf("unknown sink %q: want stdout, jsonl:<file> or webhook:<url>", spec)
+		}
+		if err != nil {
+			sinks.Close()
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+// multiSink emits every record to all of its sinks.
+type multiSink []sink
+
+func (ms multiSink) emit(r record) error {
+	var first error
+	for _, s := range ms {
+		if err := s.emit(r); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (ms multiSink) Close() error {
+	var first error
+	for _, s := range ms {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// textSink writes records in the human-readable form.
+type textSink struct {
+	w io.Writer
+}
+
+func (s textSink) emit(r record) error {
+	r.writeText(s.w)
+	return nil
+}
+
+func (s textSink) Close() error {
+	return nil
+}
+
+// jsonlSink writes one JSON envelope per line, straight through, so that
+// the file can be tailed.
+type jsonlSink struct {
+	f   *os.File
+	enc *json.Encoder
+}
+
+func newJSONLSink(path string) (*jsonlSink, error) {
+	if path == "" {
+		return nil, fmt.Errorf("jsonl sink needs a file: jsonl:<file>")
+	}
+	if path == "-" {
+		return &jsonlSink{enc: json.NewEncoder(os.Stdout)}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonlSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (s *jsonlSink) emit(r record) error {
+	return s.enc.Encode(sinkEnvelope{Type: r.kind(), Time: time.Now().UTC(), Data: r})
+}
+
+func (s *jsonlSink) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// Bounds of the webhook delivery retries.
+const (
+	webhookAttempts   = 5
+	webhookRetryDelay = 500 * time.Millisecond
+	webhookTimeout    = 10 * time.Second
+)
+
+// webhookSink POSTs records as JSON arrays of envelopes. Records are
+// batched up to batchSize or flushInterval, whichever comes first. A batch
+// that cannot be delivered after the retries is written to the spool
+// directory, and spooled batches are delivered, oldest first, before any
+// newer one so that the receiver sees records in order.
+type webhookSink struct {
+	url    string
+	opts   webhookOptions
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []sinkEnvelope
+
+	batches chan []sinkEnvelope
+	done    chan struct{}
+	stop    chan struct{}
+}
+
+func newWebhookSink(url string, opts webhookOptions) (*webhookSink, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("webhook sink needs an http(s) URL: webhook:<url>")
+	}
+	if opts.batchSize <= 0 {
+		opts.batchSize = 1
+	}
+	if opts.flushInterval <= 0 {
+		opts.flushInterval = time.Second
+	}
+	// Every webhook spools into its own directory so that batches are
+	// only ever delivered to the URL they were meant for.
+	sum := sha256.Sum256([]byte(url))
+	opts.spoolDir = filepath.Join(opts.spoolDir, hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(opts.spoolDir, 0o755); err != nil {
+		return nil, fmt.Errorf("spool directory: %w", err)
+	}
+	s := &webhookSink{
+		url:     url,
+		opts:    opts,
+		client:  &http.Client{Timeout: webhookTimeout},
+		batches: make(chan []sinkEnvelope, 16),
+		done:    make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	go s.loop()
+	return s, nil
+}
+
+func (s *webhookSink) emit(r record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, sinkEnvelope{Type: r.kind(), Time: time.Now().UTC(), Data: r})
+	if len(s.pending) >= s.opts.batchSize {
+		// Never block the watcher: while deliveries are backed up the
+		// records keep accumulating into a larger batch.
+		select {
+		case s.batches <- s.pending:
+			s.pending = nil
+		default:
+		}
+	}
+	return nil
+}
+
+// take hands the pending records over as a batch.
+func (s *webhookSink) take() []sinkEnvelope {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	batch := s.pending
+	s.pending = nil
+	return batch
+}
+
+// loop delivers the batches in order until Close.
+func (s *webhookSink) loop() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.opts.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case batch := <-s.batches:
+			s.deliver(batch)
+		case <-ticker.C:
+			if !s.flush() {
+				s.deliverSpool()
+			}
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush delivers the queued batches and then the pending records, keeping
+// their order. It reports whether there was anything to deliver.
+func (s *webhookSink) flush() bool {
+	delivered := false
+	for queued := true; queued; {
+		select {
+		case batch := <-s.batches:
+			s.deliver(batch)
+			delivered = true
+		default:
+			queued = false
+		}
+	}
+	if batch := s.take(); len(batch) > 0 {
+		s.deliver(batch)
+		delivered = true
+	}
+	return delivered
+}
+
+// deliver sends batch after the spooled batches, or spools it if that
+// fails.
+func (s *webhookSink) deliver(batch []sinkEnvelope) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		log.WithError(err).Error("Webhook sink: failed to encode batch")
+		return
+	}
+	if s.deliverSpool() && s.post(body) == nil {
+		return
+	}
+	s.spool(body)
+}
+
+// deliverSpool sends the spooled batches, oldest first, and reports whether
+// the spool is empty afterwards.
+func (s *webhookSink) deliverSpool() bool {
+	files, err := filepath.Glob(filepath.Join(s.opts.spoolDir, "*.json"))
+	if err != nil || len(files) == 0 {
+		return err == nil
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		body, err := os.ReadFile(file)
+		if err != nil {
+			log.WithError(err).Errorf("Webhook sink: failed to read spooled batch %s", file)
+			return false
+		}
+		if s.post(body) != nil {
+			return false
+		}
+		if err := os.Remove(file); err != nil {
+			log.WithError(err).Errorf("Webhook sink: failed to remove delivered batch %s", file)
+			return false
+		}
+		log.Infof("Webhook sink: delivered spooled batch %s", filepath.Base(file))
+	}
+	return true
+}
+
+// post sends one batch, retrying with exponential backoff.
+func (s *webhookSink) post(body []byte) error {
+	delay := webhookRetryDelay
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = s.postOnce(body); err == nil {
+			return nil
+		}
+		if attempt < webhookAttempts {
+			log.Warnf("Webhook sink: POST %s failed (attempt %d/%d): %v", s.url, attempt, webhookAttempts, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	log.Errorf("Webhook sink: POST %s failed: %v", s.url, err)
+	return err
+}
+
+func (s *webhookSink) postOnce(body []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
+
+// spool keeps an undelivered batch on disk. File names sort in the order
+// the batches were produced.
+func (s *webhookSink) spool(body []byte) {
+	name := filepath.Join(s.opts.spoolDir, fmt.Sprintf("%020d.json", time.Now().UnixNano()))
+	if err := os.WriteFile(name, body, 0o644); err != nil {
+		log.WithError(err).Errorf("Webhook sink: failed to spool batch, %d bytes lost", len(body))
+		return
+	}
+	log.Warnf("Webhook sink: spooled undelivered batch to %s", name)
+}
+
+// Close delivers, or spools, the records still buffered.
+func (s *webhookSink) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// testRecord is a record carrying only a sequence number.
+type testRecord struct {
+	Seq int `json:"seq"`
+}
+
+func (r *testRecord) kind() string { return "test" }
+
+func (r *testRecord) writeText(w io.Writer) { fmt.Fprintln(w, r.Seq) }
+
+// testWebhook records the sequence numbers of the batches POSTed to it.
+type testWebhook struct {
+	mu      sync.Mutex
+	batches [][]int
+}
+
+func (h *testWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var batch []struct {
+		Data testRecord `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var seqs []int
+	for _, e := range batch {
+		seqs = append(seqs, e.Data.Seq)
+	}
+	h.mu.Lock()
+	h.batches = append(h.batches, seqs)
+	h.mu.Unlock()
+}
+
+func TestWebhookSpoolOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		spooled map[string][]int // spool file name to the batch in it
+		want    [][]int
+	}{
+		{name: "empty spool", want: [][]int{{100, 101}}},
+		{
+			name: "spooled batches first, oldest first",
+			spooled: map[string][]int{
+				"00000000000000000003.json": {5, 6},
+				"00000000000000000001.json": {1, 2},
+				"00000000000000000002.json": {3, 4},
+			},
+			want: [][]int{{1, 2}, {3, 4}, {5, 6}, {100, 101}},
+		},
+	}
+	for _, tt := range tests {
+		hook := &testWebhook{}
+		srv := httptest.NewServer(hook)
+		dir := t.TempDir()
+		for name, seqs := range tt.spooled {
+			var batch []sinkEnvelope
+			for _, seq := range seqs {
+				batch = append(batch, sinkEnvelope{Type: "test", Data: &testRecord{Seq: seq}})
+			}
+			body, _ := json.Marshal(batch)
+			if err := os.WriteFile(filepath.Join(dir, name), body, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s := &webhookSink{url: srv.URL, opts: webhookOptions{spoolDir: dir}, client: srv.Client()}
+		s.deliver([]sinkEnvelope{{Type: "test", Data: &testRecord{Seq: 100}}, {Type: "test", Data: &testRecord{Seq: 101}}})
+		srv.Close()
+
+		if !reflect.DeepEqual(hook.batches, tt.want) {
+			t.Errorf("%s: delivered %v, want %v", tt.name, hook.batches, tt.want)
+		}
+		if left, _ := filepath.Glob(filepath.Join(dir, "*.json")); len(left) > 0 {
+			t.Errorf("%s: %d batches left in the spool", tt.name, len(left))
+		}
+	}
+}
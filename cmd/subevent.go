@@ -2,20 +2,34 @@ package cmd
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/ethclient/gethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/xueqianLu/ethtools/erc20"
+	"io"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
 )
 
 const (
 	ChainEndpointFlag   = "chain-endpoint"
 	MonitorCountFlag    = "monitor-count"
 	ContractAddressFlag = "token-address"
+	FromFlag            = "from"
+	ToFlag              = "to"
+	MinAmountFlag       = "min-amount"
+	TokenListFlag       = "token-list"
+	PendingTTLFlag      = "pending-ttl"
 )
 
 // newBlockCmd represents the new block command
@@ -25,6 +39,8 @@ var newBlockCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		chainEndpoint, _ := cmd.Flags().GetString(ChainEndpointFlag)
 		count, _ := cmd.Flags().GetInt64(MonitorCountFlag)
+		pollInterval, _ := cmd.Flags().GetDuration(PollIntervalFlag)
+		metricsAddr, _ := cmd.Flags().GetString(MetricsAddrFlag)
 		if chainEndpoint == "" {
 			log.Errorf("Chain endpoint is required")
 			return
@@ -32,146 +48,1162 @@ var newBlockCmd = &cobra.Command{
 		if count == 0 {
 			count = 20
 		}
-		listenForNewBlocks(chainEndpoint, count)
+		if pollInterval <= 0 {
+			log.Errorf("Poll interval must be > 0")
+			return
+		}
+		if err := startMetrics(metricsAddr); err != nil {
+			log.WithError(err).Error("Failed to start the metrics server")
+			return
+		}
+		out, err := sinkFromFlags(cmd, "block", "reorg")
+		if err != nil {
+			log.WithError(err).Error("Failed to set up the output")
+			return
+		}
+		defer out.Close()
+		if err := listenForNewBlocks(cmd.Context(), chainEndpoint, count, pollInterval, out); err != nil && !stopped(cmd) {
+			log.WithError(err).Error("newblock failed")
+		}
 	},
 }
 
 // transferEventCmd represents the transfer event command
 var transferEventCmd = &cobra.Command{
 	Use:   "transfer",
-	Short: "Listen for Transfer events from an ERC-20 contract",
+	Short: "Listen for Transfer events from ERC-20 contracts",
 	Run: func(cmd *cobra.Command, args []string) {
 		chainEndpoint, _ := cmd.Flags().GetString(ChainEndpointFlag)
 		if chainEndpoint == "" {
 			log.Errorf("Chain endpoint is required")
 			return
 		}
-		contractAddressStr, _ := cmd.Flags().GetString(ContractAddressFlag)
-		if contractAddressStr == "" {
-			log.Errorf("Contract address is required")
+		contractAddressStrs, _ := cmd.Flags().GetStringSlice(ContractAddressFlag)
+		tokenList, _ := cmd.Flags().GetString(TokenListFlag)
+		maxAddresses, _ := cmd.Flags().GetInt(MaxAddressesFlag)
+		if len(contractAddressStrs) == 0 && tokenList == "" {
+			log.Errorf("Contract address or token list is required")
+			return
+		}
+
+		fromStrs, _ := cmd.Flags().GetStringSlice(FromFlag)
+		toStrs, _ := cmd.Flags().GetStringSlice(ToFlag)
+		minAmount, _ := cmd.Flags().GetString(MinAmountFlag)
+		fromBlock, _ := cmd.Flags().GetUint64(FromBlockFlag)
+		metricsAddr, _ := cmd.Flags().GetString(MetricsAddrFlag)
+
+		contractAddresses, err := loadAddresses(contractAddressStrs, "")
+		if err != nil {
+			log.WithError(err).Error("Invalid --token-address")
+			return
+		}
+		from, err := loadAddresses(fromStrs, "")
+		if err != nil {
+			log.WithError(err).Error("Invalid --from")
+			return
+		}
+		to, err := loadAddresses(toStrs, "")
+		if err != nil {
+			log.WithError(err).Error("Invalid --to")
 			return
 		}
+		if err := startMetrics(metricsAddr); err != nil {
+			log.WithError(err).Error("Failed to start the metrics server")
+			return
+		}
+		out, err := sinkFromFlags(cmd, "transfer")
+		if err != nil {
+			log.WithError(err).Error("Failed to set up the output")
+			return
+		}
+		defer out.Close()
 
-		contractAddress := common.HexToAddress(contractAddressStr)
-		listenForTransferEvents(chainEndpoint, contractAddress)
+		err = listenForTransferEvents(cmd.Context(), chainEndpoint, out, transferOptions{
+			tokens:       contractAddresses,
+			tokenList:    tokenList,
+			maxAddresses: maxAddresses,
+			from:         from,
+			to:           to,
+			minAmount:    minAmount,
+			fromBlock:    fromBlock,
+		})
+		if err != nil && !stopped(cmd) {
+			log.WithError(err).Error("transfer failed")
+		}
+	},
+}
+
+// mempoolCmd represents the mempool command
+var mempoolCmd = &cobra.Command{
+	Use:   "mempool",
+	Short: "Watch pending transactions and how long they wait until mined",
+	Run: func(cmd *cobra.Command, args []string) {
+		chainEndpoint, _ := cmd.Flags().GetString(ChainEndpointFlag)
+		fromStrs, _ := cmd.Flags().GetStringSlice(FromFlag)
+		toStrs, _ := cmd.Flags().GetStringSlice(ToFlag)
+		pendingTTL, _ := cmd.Flags().GetDuration(PendingTTLFlag)
+		if chainEndpoint == "" {
+			log.Errorf("Chain endpoint is required")
+			return
+		}
+		from, err := loadAddresses(fromStrs, "")
+		if err != nil {
+			log.WithError(err).Error("Invalid --from")
+			return
+		}
+		to, err := loadAddresses(toStrs, "")
+		if err != nil {
+			log.WithError(err).Error("Invalid --to")
+			return
+		}
+		out, err := sinkFromFlags(cmd, "mempool")
+		if err != nil {
+			log.WithError(err).Error("Failed to set up the output")
+			return
+		}
+		defer out.Close()
+
+		m := &mempoolMonitor{out: out, from: addressSet(from), to: addressSet(to), pendingTTL: pendingTTL}
+		err = m.run(cmd.Context(), chainEndpoint)
+		m.summary()
+		if err != nil && !stopped(cmd) {
+			log.WithError(err).Error("mempool failed")
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(newBlockCmd)
 	rootCmd.AddCommand(transferEventCmd)
+	rootCmd.AddCommand(mempoolCmd)
 
 	newBlockCmd.Flags().String(ChainEndpointFlag, "", "Chain endpoint URL")
 	newBlockCmd.Flags().Int64(MonitorCountFlag, 20, "Sub block count to stop")
+	newBlockCmd.Flags().Duration(PollIntervalFlag, 2*time.Second, "Head polling interval, used for http(s) endpoints and endpoints without subscriptions")
+	newBlockCmd.Flags().String(MetricsAddrFlag, "", "Serve Prometheus metrics on this address, e.g. :9100 (disabled if empty)")
+	addSinkFlags(newBlockCmd)
 
 	transferEventCmd.Flags().String(ChainEndpointFlag, "", "Chain endpoint URL")
-	transferEventCmd.Flags().String(ContractAddressFlag, "", "ERC-20 contract address")
+	transferEventCmd.Flags().StringSlice(ContractAddressFlag, nil, "ERC-20 contract address (repeatable)")
+	transferEventCmd.Flags().String(TokenListFlag, "", "Token list file to watch: a Uniswap token list (JSON) or CSV with address[,symbol[,decimals]] lines")
+	transferEventCmd.Flags().Int(MaxAddressesFlag, 1000, "Maximum number of token addresses per FilterLogs call of the backfill. 0 means no limit")
+	transferEventCmd.Flags().StringSlice(FromFlag, nil, "Only show transfers from this address (repeatable)")
+	transferEventCmd.Flags().StringSlice(ToFlag, nil, "Only show transfers to this address (repeatable)")
+	transferEventCmd.Flags().String(MinAmountFlag, "", "Only show transfers of at least this many tokens, in token units, e.g. 1000.5")
+	transferEventCmd.Flags().Uint64(FromBlockFlag, 0, "Show the transfers since this block before streaming new ones. 0 streams new transfers only")
+	transferEventCmd.Flags().String(MetricsAddrFlag, "", "Serve Prometheus metrics on this address, e.g. :9100 (disabled if empty)")
+	addSinkFlags(transferEventCmd)
+
+	mempoolCmd.Flags().String(ChainEndpointFlag, "", "Chain endpoint URL (must support subscriptions)")
+	mempoolCmd.Flags().StringSlice(FromFlag, nil, "Only track transactions sent by this address (repeatable)")
+	mempoolCmd.Flags().StringSlice(ToFlag, nil, "Only track transactions to this address (repeatable)")
+	mempoolCmd.Flags().Duration(PendingTTLFlag, 30*time.Minute, "Report a transaction as stuck and stop tracking it after it has been pending this long")
+	addSinkFlags(mempoolCmd)
 }
 
-func listenForNewBlocks(chainEndpoint string, totalCount int64) {
-	client, err := ethclient.Dial(chainEndpoint)
+// Bounds of the exponential backoff between reconnection attempts.
+var (
+	minReconnectDelay = 1 * time.Second
+	maxReconnectDelay = 1 * time.Minute
+)
+
+// reorgWindow is the number of recent block hashes blockMonitor keeps to
+// find the common ancestor of a reorg.
+const reorgWindow = 128
+
+// listenForNewBlocks prints new blocks until totalCount blocks have been
+// printed or ctx is done, and then the summary of the printed blocks.
+func listenForNewBlocks(ctx context.Context, chainEndpoint string, totalCount int64, pollInterval time.Duration, out sink) error {
+	m := &blockMonitor{endpoint: chainEndpoint, totalCount: totalCount, pollInterval: pollInterval, out: out}
+	err := m.run(ctx)
+	if summary := m.stats.summary(); summary != nil {
+		m.emit(summary)
+	}
+	return err
+}
+
+// blockMonitor prints the new blocks of a chain. It remembers the last block
+// it printed so that blocks missed while disconnected, or skipped by a head
+// that jumped, are backfilled, and the hashes of the recent blocks so that
+// reorgs are detected.
+type blockMonitor struct {
+	endpoint     string
+	totalCount   int64
+	pollInterval time.Duration
+
+	count  int64
+	last   uint64 // number of the last printed block, 0 before the first
+	hashes map[uint64]common.Hash
+	reorgs int64
+	prev   *types.Header // last printed header
+	stats  blockStats
+	out    sink
+}
+
+// run subscribes to new heads and resubscribes with exponential backoff
+// whenever the subscription fails. HTTP endpoints, and endpoints that do not
+// support subscriptions, are polled instead. It returns once totalCount
+// blocks have been printed or ctx is done, or with an error if the very
+// first connection fails.
+func (m *blockMonitor) run(ctx context.Context) error {
+	if isHTTPEndpoint(m.endpoint) {
+		return m.poll(ctx)
+	}
+	delay := minReconnectDelay
+	for attempt := 0; ; attempt++ {
+		done, connected, err := m.subscribe(ctx)
+		if done || ctx.Err() != nil {
+			return nil
+		}
+		if subscriptionsUnsupported(err) {
+			log.Infof("Endpoint does not support subscriptions, polling every %s", m.pollInterval)
+			return m.poll(ctx)
+		}
+		if attempt == 0 && !connected {
+			return err
+		}
+		if connected {
+			delay = minReconnectDelay
+		}
+		log.Warnf("Head subscription lost: %v; reconnecting in %s", err, delay)
+		counterMetric(reconnectsMetric).Inc(1)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// subscriptionsUnsupported reports whether err says that the endpoint does
+// not serve subscriptions: the client refuses them on HTTP, and servers
+// answer eth_subscribe with method not found or notifications unsupported.
+func subscriptionsUnsupported(err error) bool {
+	if errors.Is(err, rpc.ErrNotificationsUnsupported) {
+		return true
+	}
+	var rpcErr rpc.Error
+	return errors.As(err, &rpcErr) && (rpcErr.ErrorCode() == -32601 || rpcErr.ErrorCode() == -32001)
+}
+
+// subscribe runs one subscription until it fails or enough blocks have been
+// printed. connected reports whether the subscription was established.
+func (m *blockMonitor) subscribe(ctx context.Context) (done bool, connected bool, err error) {
+	client, err := ethclient.DialContext(ctx, m.endpoint)
 	if err != nil {
-		log.Fatalf("Failed to connect to the Ethereum client: %v", err)
+		return false, false, fmt.Errorf("failed to connect to the Ethereum client: %w", err)
 	}
+	defer client.Close()
 
 	headers := make(chan *types.Header)
-	sub, err := client.SubscribeNewHead(context.Background(), headers)
+	sub, err := client.SubscribeNewHead(ctx, headers)
 	if err != nil {
-		log.Fatalf("Failed to subscribe to new head events: %v", err)
+		return false, false, fmt.Errorf("failed to subscribe to new head events: %w", err)
+	}
+	defer sub.Unsubscribe()
+	if m.last != 0 {
+		log.Infof("Resubscribed to new heads after block %d", m.last)
 	}
-	var count int64 = 0
 
 	for {
 		select {
+		case <-ctx.Done():
+			return false, true, nil
 		case err := <-sub.Err():
-			log.Fatal(err)
+			return false, true, err
 		case header := <-headers:
-			fmt.Println("New block mined:", header.Number.Uint64())
-			block, err := client.BlockByNumber(context.Background(), header.Number)
+			done, err := m.advance(ctx, client, header)
+			if done || err != nil {
+				return done, true, err
+			}
+		}
+	}
+}
+
+// poll checks the head every pollInterval. Errors are logged and retried on
+// the next tick, so an unreachable endpoint behaves like a dropped
+// subscription.
+func (m *blockMonitor) poll(ctx context.Context) error {
+	client, err := ethclient.DialContext(ctx, m.endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the Ethereum client: %w", err)
+	}
+	defer client.Close()
+
+	for {
+		header, err := client.HeaderByNumber(ctx, nil)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Warnf("Failed to poll head: %v", err)
+		} else {
+			done, err := m.advance(ctx, client, header)
+			if done || ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				log.Warnf("Failed to process head %d: %v", header.Number.Uint64(), err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(m.pollInterval):
+		}
+	}
+}
+
+// advance processes a new head, first backfilling every block between the
+// last printed one and the head. If the head does not build on the printed
+// blocks, the reorg is reported and the new branch is printed from the
+// common ancestor.
+func (m *blockMonitor) advance(ctx context.Context, client *ethclient.Client, header *types.Header) (bool, error) {
+	number := header.Number.Uint64()
+	if m.last == 0 {
+		return m.handle(ctx, client, header)
+	}
+	if m.hashes[number] == header.Hash() {
+		log.Debugf("Skipping block %d, already seen", number)
+		return false, nil
+	}
+
+	var branch []*types.Header
+	if number > m.last+1 {
+		log.Warnf("Missed blocks %d..%d, backfilling", m.last+1, number-1)
+		for n := m.last + 1; n < number; n++ {
+			missed, err := client.HeaderByNumber(ctx, new(big.Int).SetUint64(n))
 			if err != nil {
-				log.Errorf("Failed to get block: %v", err)
+				return false, fmt.Errorf("backfill block %d: %w", n, err)
+			}
+			branch = append(branch, missed)
+		}
+	}
+	branch = append(branch, header)
+
+	first := branch[0]
+	if first.Number.Uint64() <= m.last || first.ParentHash != m.hashes[first.Number.Uint64()-1] {
+		prefix, err := m.reorg(ctx, client, branch)
+		if err != nil {
+			return false, err
+		}
+		branch = append(prefix, branch...)
+	}
+
+	for _, h := range branch {
+		if done, err := m.handle(ctx, client, h); done || err != nil {
+			return done, err
+		}
+	}
+	return false, nil
+}
+
+// reorg walks the new branch back from its first block to the common
+// ancestor with the printed blocks, reports the reorg and rewinds the
+// monitor to the ancestor. It returns the new branch blocks between the
+// ancestor and the first block of branch.
+func (m *blockMonitor) reorg(ctx context.Context, client *ethclient.Client, branch []*types.Header) ([]*types.Header, error) {
+	first, head := branch[0], branch[len(branch)-1]
+	var prefix []*types.Header
+	h := first
+	for {
+		parent := h.Number.Uint64() - 1
+		known, ok := m.hashes[parent]
+		if !ok {
+			log.Errorf("Reorg at block %d is deeper than the %d tracked blocks, continuing on the new branch", first.Number.Uint64(), reorgWindow)
+			m.hashes = nil
+			return prefix, nil
+		}
+		if known == h.ParentHash {
+			break
+		}
+		p, err := client.HeaderByHash(ctx, h.ParentHash)
+		if err != nil {
+			return nil, fmt.Errorf("reorg: fetch block %s: %w", h.ParentHash.Hex(), err)
+		}
+		prefix = append([]*types.Header{p}, prefix...)
+		h = p
+	}
+	ancestor := h.Number.Uint64() - 1
+
+	oldBranch := make([]common.Hash, 0, m.last-ancestor)
+	for n := ancestor + 1; n <= m.last; n++ {
+		oldBranch = append(oldBranch, m.hashes[n])
+	}
+	newBranch := make([]common.Hash, 0, len(prefix)+len(branch))
+	for _, p := range prefix {
+		newBranch = append(newBranch, p.Hash())
+	}
+	for _, b := range branch {
+		newBranch = append(newBranch, b.Hash())
+	}
+
+	dropped, added := m.reorgTxs(ctx, client, oldBranch, newBranch)
+	depth := m.last - ancestor
+	m.reorgs++
+	counterMetric(reorgsMetric).Inc(1)
+
+	log.Warnf("Reorg detected: depth=%d ancestor=%d old head=%s new head=%s dropped txs=%d added txs=%d",
+		depth, ancestor, oldBranch[len(oldBranch)-1].Hex(), head.Hash().Hex(), len(dropped), len(added))
+	m.emit(&reorgRecord{
+		Block:        ancestor + 1,
+		Depth:        depth,
+		Ancestor:     ancestor,
+		AncestorHash: m.hashes[ancestor],
+		OldBranch:    oldBranch,
+		NewBranch:    newBranch,
+		Dropped:      dropped,
+		Added:        added,
+	})
+
+	for n := ancestor + 1; n <= m.last; n++ {
+		delete(m.hashes, n)
+	}
+	m.last = ancestor
+	return prefix, nil
+}
+
+// reorgTxs returns the transactions of the old branch missing from the new
+// one and the other way around. Blocks the node no longer serves are
+// skipped with a warning.
+func (m *blockMonitor) reorgTxs(ctx context.Context, client *ethclient.Client, oldBranch, newBranch []common.Hash) (dropped, added []common.Hash) {
+	txs := func(branch []common.Hash) map[common.Hash]bool {
+		set := make(map[common.Hash]bool)
+		for _, hash := range branch {
+			block, err := client.BlockByHash(ctx, hash)
+			if err != nil {
+				log.Warnf("Reorg: transactions of block %s unavailable: %v", hash.Hex(), err)
 				continue
 			}
-			fmt.Println("Block Number:", block.Number().String())
-			fmt.Println("Block Hash:", block.Hash().Hex())
-			fmt.Println("Block Timestamp:", block.Time())
-			fmt.Println("Number of Transactions:", len(block.Transactions()))
-			count++
-			if count >= totalCount {
-				fmt.Println("Reached the specified block count. Exiting...")
-				return
+			for _, tx := range block.Transactions() {
+				set[tx.Hash()] = true
 			}
 		}
+		return set
+	}
+	oldTxs, newTxs := txs(oldBranch), txs(newBranch)
+	for hash := range oldTxs {
+		if !newTxs[hash] {
+			dropped = append(dropped, hash)
+		}
+	}
+	for hash := range newTxs {
+		if !oldTxs[hash] {
+			added = append(added, hash)
+		}
 	}
+	return dropped, added
 }
 
-func listenForTransferEvents(chainEndpoint string, contractAddress common.Address) {
-	client, err := ethclient.Dial(chainEndpoint)
+// reorgRecord is the newblock output for a reorg.
+type reorgRecord struct {
+	Block        uint64        `json:"block"` // first replaced block
+	Depth        uint64        `json:"depth"`
+	Ancestor     uint64        `json:"ancestor"`
+	AncestorHash common.Hash   `json:"ancestorHash"`
+	OldBranch    []common.Hash `json:"oldBranch"`
+	NewBranch    []common.Hash `json:"newBranch"`
+	Dropped      []common.Hash `json:"droppedTxs"`
+	Added        []common.Hash `json:"addedTxs"`
+}
+
+func (r *reorgRecord) kind() string { return "reorg" }
+
+func (r *reorgRecord) writeText(w io.Writer) {
+	fmt.Fprintln(w, "Reorg detected at block:", r.Block)
+	fmt.Fprintln(w, "Reorg Depth:", r.Depth)
+	fmt.Fprintln(w, "Common Ancestor:", r.Ancestor, r.AncestorHash.Hex())
+	fmt.Fprintln(w, "Old Branch:", hashList(r.OldBranch))
+	fmt.Fprintln(w, "New Branch:", hashList(r.NewBranch))
+	fmt.Fprintln(w, "Dropped Transactions:", hashList(r.Dropped))
+	fmt.Fprintln(w, "Added Transactions:", hashList(r.Added))
+}
+
+func hashList(hashes []common.Hash) string {
+	strs := make([]string, len(hashes))
+	for i, h := range hashes {
+		strs[i] = h.Hex()
+	}
+	return "[" + strings.Join(strs, ", ") + "]"
+}
+
+// isHTTPEndpoint reports whether endpoint is a plain http(s) URL, which
+// cannot carry subscriptions.
+func isHTTPEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "http" || u.Scheme == "https"
+}
+
+// handle prints one block and reports whether totalCount has been reached.
+// The block only counts as printed once it has been emitted, so a block
+// that cannot be fetched is retried with the next head.
+func (m *blockMonitor) handle(ctx context.Context, client *ethclient.Client, header *types.Header) (bool, error) {
+	block, err := client.BlockByHash(ctx, header.Hash())
+	if err != nil {
+		return false, fmt.Errorf("get block %d: %w", header.Number.Uint64(), err)
+	}
+	parent := m.parentOf(ctx, client, header)
+	info := newBlockInfo(block, parent)
+	m.stats.add(block, info)
+	gaugeMetric(headHeightMetric).Update(block.Number().Int64())
+	gaugeFloat64Metric(gasUtilizationMetric).Update(info.utilization())
+	if info.hasInterval {
+		histogramMetric(blockIntervalMetric).Update(int64(info.interval))
+	}
+	m.emit(newBlockRecord(block, info))
+	m.track(header)
+	m.prev = header
+	m.count++
+	if m.count >= m.totalCount {
+		log.Info("Reached the specified block count. Exiting...")
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *blockMonitor) emit(r record) {
+	if err := m.out.emit(r); err != nil {
+		log.WithError(err).Warnf("Failed to write %s record", r.kind())
+	}
+}
+
+// parentOf returns the parent of header, reusing the last printed header
+// when it is the parent. It returns nil if the parent cannot be fetched.
+func (m *blockMonitor) parentOf(ctx context.Context, client *ethclient.Client, header *types.Header) *types.Header {
+	if m.prev != nil && m.prev.Hash() == header.ParentHash {
+		return m.prev
+	}
+	if header.Number.Sign() == 0 {
+		return nil
+	}
+	parent, err := client.HeaderByHash(ctx, header.ParentHash)
+	if err != nil {
+		log.Debugf("Parent of block %d unavailable: %v", header.Number.Uint64(), err)
+		return nil
+	}
+	return parent
+}
+
+// track records header as the last printed block and forgets hashes that
+// have fallen out of the reorg window.
+func (m *blockMonitor) track(header *types.Header) {
+	if m.hashes == nil {
+		m.hashes = make(map[uint64]common.Hash)
+	}
+	m.last = header.Number.Uint64()
+	m.hashes[m.last] = header.Hash()
+	if m.last > reorgWindow {
+		delete(m.hashes, m.last-reorgWindow)
+	}
+}
+
+// transferOptions are the tokens and filters of the transfer command.
+type transferOptions struct {
+	tokens       []common.Address
+	tokenList    string // token list file, empty for none
+	maxAddresses int
+	from         []common.Address
+	to           []common.Address
+	minAmount    string // in token units, empty for no minimum
+	fromBlock    uint64 // first block to backfill, 0 for live events only
+}
+
+// listenForTransferEvents streams the Transfer events of every watched
+// token through a single log subscription, optionally after backfilling the
+// events since opts.fromBlock. It runs until ctx is done or the
+// subscription fails, and then logs how many transfers it showed.
+func listenForTransferEvents(ctx context.Context, chainEndpoint string, out sink, opts transferOptions) error {
+	client, err := ethclient.DialContext(ctx, chainEndpoint)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the Ethereum client: %w", err)
+	}
+	defer client.Close()
+	tokens, err := resolveTokens(ctx, client, opts.tokens, opts.tokenList)
+	if err != nil {
+		return fmt.Errorf("failed to load the tokens: %w", err)
+	}
+	addresses := make([]common.Address, 0, len(tokens))
+	minAmounts := make(map[common.Address]*big.Int)
+	for addr, token := range tokens {
+		addresses = append(addresses, addr)
+		if opts.minAmount != "" {
+			if minAmounts[addr], err = parseTokenAmount(opts.minAmount, token.decimals); err != nil {
+				return fmt.Errorf("invalid --min-amount for %s: %w", token.symbol, err)
+			}
+		}
+	}
+	log.Infof("Watching Transfer events of %d tokens", len(tokens))
+
+	// Any binding can decode the logs, ParseTransfer does not look at the
+	// contract address.
+	parser, err := erc20.NewErc20Filterer(common.Address{}, client)
+	if err != nil {
+		return fmt.Errorf("failed to bind the token contract: %w", err)
+	}
+	parsed, err := abi.JSON(strings.NewReader(erc20.Erc20ABI))
 	if err != nil {
-		log.Fatalf("Failed to connect to the Ethereum client: %v", err)
+		return fmt.Errorf("failed to parse the token ABI: %w", err)
 	}
-	contract, _ := erc20.NewErc20(contractAddress, client)
-	// Create a channel to receive events
-	events := make(chan *erc20.Erc20Transfer)
-	//contract.WatchTransfer()
+	// Let the node filter on the indexed from and to arguments.
+	topics := [][]common.Hash{{parsed.Events["Transfer"].ID}, addressTopics(opts.from), addressTopics(opts.to)}
+
 	// Subscribe to Transfer events
-	opts := &bind.WatchOpts{Context: context.Background()}
-	subscription, err := contract.WatchTransfer(opts, events, nil, nil)
+	logs := make(chan types.Log)
+	subscription, err := client.SubscribeFilterLogs(ctx, ethereum.FilterQuery{Addresses: addresses, Topics: topics}, logs)
 	if err != nil {
-		log.Fatalf("Failed to subscribe to Transfer events: %v", err)
-		return
+		return fmt.Errorf("failed to subscribe to Transfer events: %w", err)
 	}
 	defer subscription.Unsubscribe()
 
-	// Listen for events
+	shown := make(map[common.Address]int)
+	var removed int
+	defer func() {
+		total := 0
+		for addr, n := range shown {
+			total += n
+			log.Infof("transfer summary: token=%s transfers=%d", tokens[addr].symbol, n)
+		}
+		log.Infof("transfer summary: tokens=%d transfers=%d removed=%d", len(tokens), total, removed)
+	}()
+
+	show := func(l types.Log) {
+		event, err := parser.ParseTransfer(l)
+		if err != nil {
+			// ERC-721 Transfer events share the topic but index the
+			// token id as well.
+			log.Debugf("Skipping log %d of tx %s: %v", l.Index, l.TxHash.Hex(), err)
+			return
+		}
+		token := tokens[l.Address]
+		if min := minAmounts[l.Address]; min != nil && event.Value.Cmp(min) < 0 {
+			return
+		}
+		r := &transferRecord{
+			Block:    event.Raw.BlockNumber,
+			TxHash:   event.Raw.TxHash,
+			LogIndex: event.Raw.Index,
+			Token:    event.Raw.Address,
+			Symbol:   token.symbol,
+			From:     event.From,
+			To:       event.To,
+			Value:    event.Value.String(),
+			Amount:   formatTokenAmount(event.Value, token.decimals),
+			Removed:  event.Raw.Removed,
+		}
+		if err := out.emit(r); err != nil {
+			log.WithError(err).Warn("Failed to write transfer record")
+		}
+		if r.Removed {
+			removed++
+		} else {
+			shown[l.Address]++
+		}
+		counterMetric(tokenMetric(transferCountMetric, event.Raw.Address)).Inc(1)
+		counterFloat64Metric(tokenMetric(transferVolumeMetric, event.Raw.Address)).Inc(tokenUnits(event.Value, token.decimals))
+	}
+
+	var (
+		history  <-chan types.Log
+		errc     <-chan error
+		backfill uint64
+	)
+	if opts.fromBlock > 0 {
+		head, err := client.BlockNumber(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get the head block: %w", err)
+		}
+		if opts.fromBlock <= head {
+			log.Infof("Backfilling transfers of blocks %d..%d", opts.fromBlock, head)
+			history, errc = backfillLogs(ctx, client, opts.fromBlock, head, addresses, opts.maxAddresses, topics)
+			backfill = head
+		}
+	}
+	return handOverLogs(ctx, history, errc, backfill, logs, subscription.Err(), show)
+}
+
+// handOverLogs shows the logs of history, the backfill of the blocks up to
+// backfill, and then the live logs of a subscription. The subscription is
+// already running when the backfill head is read, so every block after it
+// reaches the subscription; live logs arriving during the backfill are
+// held back, and those of blocks the backfill already showed are dropped.
+// Backfilled logs of the last reorgWindow blocks are remembered by block
+// hash, so that a reorg of those blocks still shows the removals and the
+// new branch. Without a backfill history is nil. It runs until ctx is done
+// or either source fails.
+func handOverLogs(ctx context.Context, history <-chan types.Log, errc <-chan error, backfill uint64, logs <-chan types.Log, subErr <-chan error, show func(types.Log)) error {
+	type logKey struct {
+		block common.Hash
+		tx    common.Hash
+		index uint
+	}
+	var (
+		backlog []types.Log
+		recent  = make(map[logKey]bool)
+	)
+	live := func(l types.Log) {
+		// Up to the backfilled head, show new logs the backfill missed
+		// and removals of logs it showed.
+		if l.BlockNumber <= backfill && l.Removed != recent[logKey{l.BlockHash, l.TxHash, l.Index}] {
+			return
+		}
+		show(l)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-subErr:
+			return fmt.Errorf("transfer subscription: %w", err)
+		case err := <-errc:
+			return fmt.Errorf("backfill failed: %w", err)
+		case l, ok := <-history:
+			if ok {
+				if l.BlockNumber+reorgWindow > backfill {
+					recent[logKey{l.BlockHash, l.TxHash, l.Index}] = true
+				}
+				show(l)
+				continue
+			}
+			log.Infof("Backfill done, streaming live transfers from block %d", backfill+1)
+			history, errc = nil, nil
+			for _, l := range backlog {
+				live(l)
+			}
+			backlog = nil
+		case l := <-logs:
+			if history != nil {
+				backlog = append(backlog, l)
+				continue
+			}
+			live(l)
+		}
+	}
+}
+
+// transferRecord is the transfer output for one Transfer event.
+type transferRecord struct {
+	Block    uint64         `json:"block"`
+	TxHash   common.Hash    `json:"txHash"`
+	LogIndex uint           `json:"logIndex"`
+	Token    common.Address `json:"token"`
+	Symbol   string         `json:"symbol"`
+	From     common.Address `json:"from"`
+	To       common.Address `json:"to"`
+	Value    string         `json:"value"`  // base units
+	Amount   string         `json:"amount"` // token units
+	Removed  bool           `json:"removed,omitempty"`
+}
+
+func (r *transferRecord) kind() string { return "transfer" }
+
+func (r *transferRecord) writeText(w io.Writer) {
+	fmt.Fprintln(w, "Transfer Event:")
+	fmt.Fprintln(w, "Block Number:", r.Block)
+	fmt.Fprintln(w, "Transaction Hash:", r.TxHash.Hex())
+	fmt.Fprintln(w, "Contract Address:", r.Token.Hex())
+	fmt.Fprintln(w, "Token:", r.Symbol)
+	fmt.Fprintln(w, "From:", r.From.Hex())
+	fmt.Fprintln(w, "To:", r.To.Hex())
+	fmt.Fprintln(w, "Value:", r.Amount, r.Symbol)
+	if r.Removed {
+		fmt.Fprintln(w, "Removed: true")
+	}
+}
+
+// resolveTokens returns the metadata of the given tokens and of those in
+// the token list file. Symbols and decimals missing from the list are read
+// from the token contracts.
+func resolveTokens(ctx context.Context, client *ethclient.Client, addresses []common.Address, listFile string) (map[common.Address]tokenInfo, error) {
+	var listed []listedToken
+	for _, addr := range addresses {
+		listed = append(listed, listedToken{address: addr})
+	}
+	if listFile != "" {
+		chainID, err := client.ChainID(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("chain id: %w", err)
+		}
+		fromFile, err := loadTokenList(listFile, chainID)
+		if err != nil {
+			return nil, err
+		}
+		listed = append(listed, fromFile...)
+	}
+	if len(listed) == 0 {
+		return nil, fmt.Errorf("no tokens to watch")
+	}
+
+	tokens := make(map[common.Address]tokenInfo, len(listed))
+	for _, t := range listed {
+		if _, ok := tokens[t.address]; ok {
+			continue
+		}
+		info := tokenInfo{address: t.address, symbol: t.symbol}
+		if t.symbol == "" || t.decimals == nil {
+			contract, err := erc20.NewErc20(t.address, client)
+			if err != nil {
+				return nil, err
+			}
+			onchain := loadTokenInfo(ctx, contract, t.address)
+			if info.symbol == "" {
+				info.symbol = onchain.symbol
+			}
+			info.decimals = onchain.decimals
+		}
+		if t.decimals != nil {
+			info.decimals = *t.decimals
+		}
+		tokens[t.address] = info
+	}
+	return tokens, nil
+}
+
+// addressTopics encodes addresses as the values of an indexed address
+// argument. It returns nil, matching any value, for no addresses.
+func addressTopics(addresses []common.Address) []common.Hash {
+	var res []common.Hash
+	for _, a := range addresses {
+		res = append(res, common.BytesToHash(a.Bytes()))
+	}
+	return res
+}
+
+// backfillLogs pages through the logs of [from..to] matching the filter in
+// windows of MaxBlocksPerRequest blocks and sends them, in order, on the
+// returned channel, which is closed when done. A failure is sent on the
+// error channel instead.
+func backfillLogs(ctx context.Context, client *ethclient.Client, from, to uint64, addresses []common.Address, maxAddresses int, topics [][]common.Hash) (<-chan types.Log, <-chan error) {
+	out := make(chan types.Log)
+	errc := make(chan error, 1)
+	go func() {
+		for start := from; start <= to; start += MaxBlocksPerRequest {
+			end := start + MaxBlocksPerRequest - 1
+			if end > to {
+				end = to
+			}
+			logs, err := filterLogsChunked(ctx, client, start, end, addresses, maxAddresses, topics)
+			if err != nil {
+				errc <- fmt.Errorf("blocks %d..%d: %w", start, end, err)
+				return
+			}
+			for _, l := range logs {
+				select {
+				case out <- l:
+				case <-ctx.Done():
+					return
+				}
+			}
+			log.Debugf("Backfilled blocks %d..%d", start, end)
+		}
+		close(out)
+	}()
+	return out, errc
+}
+
+// mempoolMonitor tracks pending transactions from the moment the node
+// announces them until they are mined, replaced or given up on.
+type mempoolMonitor struct {
+	out        sink
+	from, to   map[common.Address]bool // empty for any
+	pendingTTL time.Duration
+
+	signer  types.Signer
+	baseFee *big.Int // of the latest head, nil before London
+	pending map[common.Hash]*pendingTx
+	nonces  map[senderNonce]common.Hash
+	counts  map[string]int // records emitted by status
+}
+
+type pendingTx struct {
+	tx   *types.Transaction
+	from common.Address
+	seen time.Time
+}
+
+type senderNonce struct {
+	from  common.Address
+	nonce uint64
+}
+
+// run subscribes to pending transactions and new heads. Full transaction
+// objects are requested where the node supports it; otherwise every
+// announced hash is looked up with eth_getTransactionByHash.
+func (m *mempoolMonitor) run(ctx context.Context, endpoint string) error {
+	rpcClient, err := rpc.DialContext(ctx, endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the Ethereum client: %w", err)
+	}
+	defer rpcClient.Close()
+	client := ethclient.NewClient(rpcClient)
+	gclient := gethclient.New(rpcClient)
+
+	chainID, err := client.ChainID(ctx)
+	if err != nil {
+		return fmt.Errorf("chain id: %w", err)
+	}
+	m.signer = types.LatestSignerForChainID(chainID)
+	m.pending = make(map[common.Hash]*pendingTx)
+	m.nonces = make(map[senderNonce]common.Hash)
+	if head, err := client.HeaderByNumber(ctx, nil); err == nil {
+		m.baseFee = head.BaseFee
+	}
+
+	heads := make(chan *types.Header)
+	headSub, err := client.SubscribeNewHead(ctx, heads)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to new head events: %w", err)
+	}
+	defer headSub.Unsubscribe()
+
+	var (
+		txs       = make(chan *types.Transaction)
+		hashes    = make(chan common.Hash)
+		txSub     *rpc.ClientSubscription
+		full      = true
+		delivered = false
+	)
+	if txSub, err = gclient.SubscribeFullPendingTransactions(ctx, txs); err != nil {
+		log.Infof("Full pending transactions unsupported (%v), looking up announced hashes", err)
+		full = false
+		if txSub, err = gclient.SubscribePendingTransactions(ctx, hashes); err != nil {
+			return fmt.Errorf("failed to subscribe to pending transactions: %w", err)
+		}
+	}
+	defer func() { txSub.Unsubscribe() }()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
 	for {
 		select {
-		case err := <-subscription.Err():
-			log.Fatal(err)
-		case event := <-events:
-			fmt.Println("Transfer Event:")
-			fmt.Println("Block Number:", event.Raw.BlockNumber)
-			fmt.Println("Transaction Hash:", event.Raw.TxHash.Hex())
-			fmt.Println("Contract Address:", event.Raw.Address.Hex())
-			fmt.Println("From:", event.From.Hex())
-			fmt.Println("To:", event.To.Hex())
-			fmt.Println("Value:", event.Value.String())
-		}
-	}
-
-	//query := ethereum.FilterQuery{
-	//	Addresses: []common.Address{contractAddress},
-	//	Topics: [][]common.Hash{
-	//		{common.HexToHash("0xddf252ad1be2b89b69c2b068fc378daa952ba778895dca41f1506ef3ca7a739b")}, // Transfer event signature
-	//	},
-	//
-	//	//Topics:    [][]common.Hash{{common.HexToHash("0xddf252ad1be2c89b69c2b068fc378daa952ba778895dca41f1506ef3ca7a739b")}}, // Transfer event signature
-	//}
-	//
-	//logs := make(chan types.Log)
-	//sub, err := client.SubscribeFilterLogs(context.Background(), query, logs)
-	//if err != nil {
-	//	log.Fatalf("Failed to subscribe to Transfer events: %v", err)
-	//}
-	//
-	//for {
-	//	select {
-	//	case err := <-sub.Err():
-	//		log.Fatal(err)
-	//	case eventLog := <-logs:
-	//		fmt.Println("Contract Event:", eventLog.Topics[0].Hex())
-	//		fmt.Println("Block Number:", eventLog.BlockNumber)
-	//		fmt.Println("Transaction Hash:", eventLog.TxHash.Hex())
-	//		fmt.Println("Contract Address:", eventLog.Address.Hex())
-	//
-	//		// Parse event data
-	//		from := common.HexToAddress(eventLog.Topics[1].Hex())
-	//		to := common.HexToAddress(eventLog.Topics[2].Hex())
-	//		value := new(big.Int).SetBytes(eventLog.Data)
-	//
-	//		fmt.Println("From:", from.Hex())
-	//		fmt.Println("To:", to.Hex())
-	//		fmt.Println("Value:", value.String())
-	//	}
-	//}
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-headSub.Err():
+			return fmt.Errorf("head subscription: %w", err)
+		case err := <-txSub.Err():
+			// Nodes that ignore the full-objects flag send hashes, which
+			// fail to decode as transactions.
+			if !full || delivered {
+				return fmt.Errorf("pending transaction subscription: %w", err)
+			}
+			log.Infof("Full pending transactions unsupported (%v), looking up announced hashes", err)
+			full = false
+			if txSub, err = gclient.SubscribePendingTransactions(ctx, hashes); err != nil {
+				return fmt.Errorf("failed to subscribe to pending transactions: %w", err)
+			}
+		case tx := <-txs:
+			delivered = true
+			m.add(tx)
+		case hash := <-hashes:
+			if _, ok := m.pending[hash]; ok {
+				continue
+			}
+			tx, isPending, err := client.TransactionByHash(ctx, hash)
+			if err != nil {
+				log.Debugf("Pending transaction %s unavailable: %v", hash.Hex(), err)
+				continue
+			}
+			if isPending {
+				m.add(tx)
+			}
+		case head := <-heads:
+			m.baseFee = head.BaseFee
+			block, err := client.BlockByHash(ctx, head.Hash())
+			if err != nil {
+				log.Warnf("Failed to get block %d: %v", head.Number.Uint64(), err)
+				continue
+			}
+			m.mined(block)
+		case <-ticker.C:
+			m.expire()
+		}
+	}
+}
+
+// add starts tracking a pending transaction that passes the filters.
+func (m *mempoolMonitor) add(tx *types.Transaction) {
+	if _, ok := m.pending[tx.Hash()]; ok {
+		return
+	}
+	from, err := types.Sender(m.signer, tx)
+	if err != nil {
+		log.Debugf("Cannot recover the sender of %s: %v", tx.Hash().Hex(), err)
+		return
+	}
+	if len(m.from) > 0 && !m.from[from] {
+		return
+	}
+	if len(m.to) > 0 && (tx.To() == nil || !m.to[*tx.To()]) {
+		return
+	}
+
+	now := time.Now()
+	key := senderNonce{from, tx.Nonce()}
+	if old, ok := m.nonces[key]; ok && old != tx.Hash() {
+		if p := m.pending[old]; p != nil {
+			replacement := tx.Hash()
+			m.emit(&mempoolTxRecord{Status: "replaced", Hash: old, From: from, Nonce: tx.Nonce(), ReplacedBy: &replacement, Wait: now.Sub(p.seen).Seconds()})
+			delete(m.pending, old)
+		}
+	}
+	m.nonces[key] = tx.Hash()
+	m.pending[tx.Hash()] = &pendingTx{tx: tx, from: from, seen: now}
+
+	r := &mempoolTxRecord{
+		Status: "pending",
+		Hash:   tx.Hash(),
+		From:   from,
+		To:     tx.To(),
+		Nonce:  tx.Nonce(),
+		Type:   tx.Type(),
+		Gas:    tx.Gas(),
+		Value:  tx.Value().String(),
+	}
+	if tx.Type() == types.LegacyTxType || tx.Type() == types.AccessListTxType {
+		r.GasPrice = tx.GasPrice().String()
+	} else {
+		r.FeeCap = tx.GasFeeCap().String()
+		r.TipCap = tx.GasTipCap().String()
+	}
+	if m.baseFee != nil {
+		if tip, err := tx.EffectiveGasTip(m.baseFee); err == nil {
+			r.EffectiveTip = tip.String()
+		} else {
+			r.EffectiveTip = "underpriced"
+		}
+	}
+	m.emit(r)
+}
+
+// mined reports the tracked transactions included in block.
+func (m *mempoolMonitor) mined(block *types.Block) {
+	now := time.Now()
+	for _, tx := range block.Transactions() {
+		p, ok := m.pending[tx.Hash()]
+		if !ok {
+			continue
+		}
+		m.emit(&mempoolTxRecord{Status: "mined", Hash: tx.Hash(), From: p.from, Nonce: tx.Nonce(), Block: block.NumberU64(), Wait: now.Sub(p.seen).Seconds()})
+		m.forget(tx.Hash(), p)
+	}
+}
+
+// expire reports and forgets the transactions pending for longer than
+// pendingTTL.
+func (m *mempoolMonitor) expire() {
+	now := time.Now()
+	for hash, p := range m.pending {
+		if wait := now.Sub(p.seen); wait > m.pendingTTL {
+			m.emit(&mempoolTxRecord{Status: "stuck", Hash: hash, From: p.from, Nonce: p.tx.Nonce(), Wait: wait.Seconds()})
+			m.forget(hash, p)
+		}
+	}
+}
+
+func (m *mempoolMonitor) forget(hash common.Hash, p *pendingTx) {
+	delete(m.pending, hash)
+	key := senderNonce{p.from, p.tx.Nonce()}
+	if m.nonces[key] == hash {
+		delete(m.nonces, key)
+	}
+}
+
+func (m *mempoolMonitor) emit(r *mempoolTxRecord) {
+	if m.counts == nil {
+		m.counts = make(map[string]int)
+	}
+	m.counts[r.Status]++
+	if err := m.out.emit(r); err != nil {
+		log.WithError(err).Warnf("Failed to write %s record", r.kind())
+	}
+}
+
+// summary logs what happened to the transactions seen so far.
+func (m *mempoolMonitor) summary() {
+	log.Infof("mempool summary: seen=%d mined=%d replaced=%d stuck=%d still pending=%d",
+		m.counts["pending"], m.counts["mined"], m.counts["replaced"], m.counts["stuck"], len(m.pending))
+}
+
+// mempoolTxRecord is the mempool output for a transaction that appeared,
+// was mined, was replaced by another with the same nonce, or got stuck.
+// Fee fields are in wei.
+type mempoolTxRecord struct {
+	Status       string          `json:"status"`
+	Hash         common.Hash     `json:"hash"`
+	From         common.Address  `json:"from"`
+	To           *common.Address `json:"to,omitempty"`
+	Nonce        uint64          `json:"nonce"`
+	Type         uint8           `json:"type,omitempty"`
+	Gas          uint64          `json:"gas,omitempty"`
+	Value        string          `json:"value,omitempty"`
+	GasPrice     string          `json:"gasPrice,omitempty"`
+	FeeCap       string          `json:"maxFeePerGas,omitempty"`
+	TipCap       string          `json:"maxPriorityFeePerGas,omitempty"`
+	EffectiveTip string          `json:"effectiveTip,omitempty"`
+	Block        uint64          `json:"block,omitempty"`
+	ReplacedBy   *common.Hash    `json:"replacedBy,omitempty"`
+	Wait         float64         `json:"wait,omitempty"` // seconds since first seen
+}
+
+func (r *mempoolTxRecord) kind() string { return "mempool" }
+
+func (r *mempoolTxRecord) writeText(w io.Writer) {
+	wait := time.Duration(r.Wait * float64(time.Second)).Round(time.Millisecond)
+	switch r.Status {
+	case "pending":
+		fmt.Fprintln(w, "Pending Transaction:", r.Hash.Hex())
+		fmt.Fprintln(w, "From:", r.From.Hex())
+		if r.To != nil {
+			fmt.Fprintln(w, "To:", r.To.Hex())
+		} else {
+			fmt.Fprintln(w, "To: contract creation")
+		}
+		fmt.Fprintln(w, "Nonce:", r.Nonce)
+		fmt.Fprintln(w, "Type:", r.Type)
+		if r.GasPrice != "" {
+			fmt.Fprintln(w, "Gas Price:", formatWeiGwei(r.GasPrice))
+		} else {
+			fmt.Fprintln(w, "Max Fee:", formatWeiGwei(r.FeeCap))
+			fmt.Fprintln(w, "Max Priority Fee:", formatWeiGwei(r.TipCap))
+		}
+		if r.EffectiveTip != "" {
+			fmt.Fprintln(w, "Effective Tip:", formatWeiGwei(r.EffectiveTip))
+		}
+	case "mined":
+		fmt.Fprintln(w, "Transaction Mined:", r.Hash.Hex())
+		fmt.Fprintln(w, "Block Number:", r.Block)
+		fmt.Fprintln(w, "Waited:", wait)
+	case "replaced":
+		fmt.Fprintln(w, "Transaction Replaced:", r.Hash.Hex())
+		fmt.Fprintln(w, "Replaced By:", r.ReplacedBy.Hex())
+		fmt.Fprintln(w, "Waited:", wait)
+	case "stuck":
+		fmt.Fprintln(w, "Transaction Stuck:", r.Hash.Hex())
+		fmt.Fprintln(w, "From:", r.From.Hex())
+		fmt.Fprintln(w, "Nonce:", r.Nonce)
+		fmt.Fprintln(w, "Pending For:", wait)
+	}
+}
+
+// formatWeiGwei renders a decimal wei string in gwei, leaving anything
+// else as is.
+func formatWeiGwei(wei string) string {
+	v, ok := new(big.Int).SetString(wei, 10)
+	if !ok {
+		return wei
+	}
+	return formatGwei(v)
+}
+
+func addressSet(addresses []common.Address) map[common.Address]bool {
+	set := make(map[common.Address]bool, len(addresses))
+	for _, a := range addresses {
+		set[a] = true
+	}
+	return set
 }
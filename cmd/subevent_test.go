@@ -0,0 +1,357 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestHandOverLogs(t *testing.T) {
+	// lg returns log index of block on the branch with the given block hash.
+	lg := func(block uint64, branch byte, index uint, removed bool) types.Log {
+		return types.Log{BlockNumber: block, BlockHash: common.Hash{branch}, TxHash: common.BigToHash(new(big.Int).SetUint64(block)), Index: index, Removed: removed}
+	}
+	// A step sends a log of the backfill or the subscription, or ends the
+	// backfill.
+	type step struct {
+		history, end bool
+		l            types.Log
+	}
+	h := func(l types.Log) step { return step{history: true, l: l} }
+	live := func(l types.Log) step { return step{l: l} }
+	end := step{end: true}
+	a5, a10, a11 := lg(5, 0xa, 0, false), lg(10, 0xa, 0, false), lg(11, 0xa, 0, false)
+
+	tests := []struct {
+		name     string
+		backfill uint64 // 0 for no backfill
+		steps    []step
+		want     []types.Log
+	}{
+		{name: "no backfill", steps: []step{live(a10), live(a11)}, want: []types.Log{a10, a11}},
+		{name: "empty backfill", backfill: 10, steps: []step{live(a11), end}, want: []types.Log{a11}},
+		{
+			name:     "overlap during the backfill",
+			backfill: 10,
+			steps:    []step{h(a5), live(a10), live(a11), h(a10), end},
+			want:     []types.Log{a5, a10, a11},
+		},
+		{
+			name:     "overlap after the backfill",
+			backfill: 10,
+			steps:    []step{h(a5), h(a10), end, live(a10), live(a11)},
+			want:     []types.Log{a5, a10, a11},
+		},
+		{
+			name:     "gap in the backfill",
+			backfill: 10,
+			steps:    []step{h(a5), end, live(lg(9, 0xa, 0, false)), live(a11)},
+			want:     []types.Log{a5, lg(9, 0xa, 0, false), a11},
+		},
+		{
+			name:     "reorg of a backfilled block",
+			backfill: 10,
+			steps:    []step{h(a5), h(a10), end, live(lg(10, 0xa, 0, true)), live(lg(10, 0xb, 0, false)), live(a11)},
+			want:     []types.Log{a5, a10, lg(10, 0xa, 0, true), lg(10, 0xb, 0, false), a11},
+		},
+		{
+			name:     "reorg during the backfill",
+			backfill: 10,
+			steps:    []step{h(a10), live(lg(10, 0xa, 0, true)), live(lg(10, 0xb, 0, false)), end},
+			want:     []types.Log{a10, lg(10, 0xa, 0, true), lg(10, 0xb, 0, false)},
+		},
+		{
+			name:     "removal of a log the backfill did not show",
+			backfill: 10,
+			steps:    []step{h(a5), end, live(lg(8, 0xa, 0, true)), live(a11)},
+			want:     []types.Log{a5, a11},
+		},
+	}
+	// The marker is the last live log; once it is shown, everything before
+	// it has been.
+	marker := lg(1000, 0xff, 0, false)
+	for _, tt := range tests {
+		var history chan types.Log
+		if tt.backfill > 0 {
+			history = make(chan types.Log)
+		}
+		logs := make(chan types.Log)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		var got []types.Log
+		result := make(chan error)
+		go func() {
+			result <- handOverLogs(ctx, history, nil, tt.backfill, logs, nil, func(l types.Log) {
+				if l.BlockNumber == marker.BlockNumber {
+					cancel()
+					return
+				}
+				got = append(got, l)
+			})
+		}()
+		for _, s := range tt.steps {
+			switch {
+			case s.end:
+				close(history)
+			case s.history:
+				history <- s.l
+			default:
+				logs <- s.l
+			}
+		}
+		logs <- marker
+		err := <-result
+		if ctx.Err() == context.DeadlineExceeded {
+			err = ctx.Err()
+		}
+		cancel()
+		if err != nil {
+			t.Errorf("%s: returned %v", tt.name, err)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: showed %d logs, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if !reflect.DeepEqual(got[i], tt.want[i]) {
+				t.Errorf("%s: log %d is block %d %s removed=%v, want block %d %s removed=%v", tt.name, i,
+					got[i].BlockNumber, got[i].BlockHash.Hex(), got[i].Removed, tt.want[i].BlockNumber, tt.want[i].BlockHash.Hex(), tt.want[i].Removed)
+			}
+		}
+	}
+}
+
+func TestHandOverLogsBackfillError(t *testing.T) {
+	history, errc := make(chan types.Log), make(chan error, 1)
+	errc <- errors.New("query timeout")
+	err := handOverLogs(context.Background(), history, errc, 10, make(chan types.Log), make(chan error), func(types.Log) {})
+	if err == nil || err.Error() != "backfill failed: query timeout" {
+		t.Errorf("returned %v, want the backfill error", err)
+	}
+}
+
+// describeBlockRecords summarizes newblock records: "blocks 11..13" for a
+// run of consecutive blocks and "reorg 11 depth 2 -2 +3" for a reorg at
+// block 11 that dropped 2 and added 3 transactions.
+func describeBlockRecords(records []record) []string {
+	var res []string
+	var from, to uint64
+	flush := func() {
+		if from != 0 {
+			res = append(res, fmt.Sprintf("blocks %d..%d", from, to))
+			from = 0
+		}
+	}
+	for _, r := range records {
+		switch r := r.(type) {
+		case *blockRecord:
+			if from != 0 && r.Number == to+1 {
+				to++
+				continue
+			}
+			flush()
+			from, to = r.Number, r.Number
+		case *reorgRecord:
+			flush()
+			res = append(res, fmt.Sprintf("reorg %d depth %d -%d +%d", r.Block, r.Depth, len(r.Dropped), len(r.Added)))
+		}
+	}
+	flush()
+	return res
+}
+
+func TestBlockMonitorReorg(t *testing.T) {
+	chain := newTestForkChain(10)
+	client := newTestClient(t, chain)
+	out := &testSink{}
+	m := &blockMonitor{totalCount: 1000, out: out}
+	steps := []struct {
+		name   string
+		change func()
+		want   []string
+	}{
+		{name: "first head", change: func() {}, want: []string{"blocks 10..10"}},
+		{name: "skipped heads", change: func() { chain.extend(12) }, want: []string{"blocks 11..12"}},
+		{name: "same head", change: func() {}},
+		// The old branch had the transactions of blocks 11 and 12, the new
+		// one those of 11, 12 and 13.
+		{name: "reorg", change: func() { chain.reorg(11, 1); chain.extend(13) }, want: []string{"reorg 11 depth 2 -2 +3", "blocks 11..13"}},
+		{name: "long chain", change: func() { chain.extend(200) }, want: []string{"blocks 14..200"}},
+		{name: "reorg in the window", change: func() { chain.reorg(101, 2); chain.extend(201) }, want: []string{"reorg 101 depth 100 -100 +101", "blocks 101..201"}},
+		// Only the hashes of blocks 74..201 are kept, so the new branch is
+		// printed from block 74 on without a reorg report.
+		{name: "reorg deeper than the window", change: func() { chain.reorg(50, 3); chain.extend(202) }, want: []string{"blocks 74..202"}},
+		{name: "reorg after the deep one", change: func() { chain.reorg(200, 4); chain.extend(203) }, want: []string{"reorg 200 depth 3 -3 +4", "blocks 200..203"}},
+	}
+	for _, step := range steps {
+		step.change()
+		out.records = nil
+		head, err := client.HeaderByNumber(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := m.advance(context.Background(), client, head); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if got := describeBlockRecords(out.records); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: got %q, want %q", step.name, got, step.want)
+		}
+		for _, r := range out.records {
+			if b, ok := r.(*blockRecord); ok && b.Hash != chain.blocks[b.Number].Hash() {
+				t.Errorf("%s: block %d printed from an old branch", step.name, b.Number)
+			}
+		}
+	}
+}
+
+// testPolledChain serves a testForkChain without subscriptions.
+type testPolledChain struct {
+	c *testForkChain
+}
+
+func (p *testPolledChain) BlockNumber() hexutil.Uint64 { return p.c.BlockNumber() }
+
+func (p *testPolledChain) GetBlockByNumber(n rpc.BlockNumber, full bool) (map[string]interface{}, error) {
+	return p.c.GetBlockByNumber(n, full)
+}
+
+func (p *testPolledChain) GetBlockByHash(hash common.Hash, full bool) (map[string]interface{}, error) {
+	return p.c.GetBlockByHash(hash, full)
+}
+
+// newTestEndpoint serves service under the eth namespace over HTTP, or
+// over a websocket with ws, and returns its URL and a function that drops
+// every connection by restarting the server.
+func newTestEndpoint(t *testing.T, service interface{}, ws bool) (string, func()) {
+	t.Helper()
+	var (
+		mu      sync.Mutex
+		srv     *rpc.Server
+		handler http.Handler
+	)
+	restart := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if srv != nil {
+			srv.Stop()
+		}
+		srv = rpc.NewServer()
+		if err := srv.RegisterName("eth", service); err != nil {
+			t.Fatal(err)
+		}
+		handler = srv
+		if ws {
+			handler = srv.WebsocketHandler([]string{"*"})
+		}
+	}
+	restart()
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		h := handler
+		mu.Unlock()
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		hs.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		srv.Stop()
+	})
+	if ws {
+		return "ws" + strings.TrimPrefix(hs.URL, "http"), restart
+	}
+	return hs.URL, restart
+}
+
+// waitFor waits until cond holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// printed returns the numbers of the blocks emitted to out.
+func printed(out *testSink) []uint64 {
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	var numbers []uint64
+	for _, r := range out.records {
+		if b, ok := r.(*blockRecord); ok {
+			numbers = append(numbers, b.Number)
+		}
+	}
+	return numbers
+}
+
+func TestBlockMonitorResubscribes(t *testing.T) {
+	minDelay, maxDelay := minReconnectDelay, maxReconnectDelay
+	minReconnectDelay, maxReconnectDelay = 10*time.Millisecond, 40*time.Millisecond
+	defer func() { minReconnectDelay, maxReconnectDelay = minDelay, maxDelay }()
+
+	chain := newTestForkChain(10)
+	endpoint, restart := newTestEndpoint(t, chain, true)
+	out := &testSink{}
+	m := &blockMonitor{endpoint: endpoint, totalCount: 4, pollInterval: time.Hour, out: out}
+	result := make(chan error, 1)
+	go func() { result <- m.run(context.Background()) }()
+
+	waitFor(t, "the subscription", func() bool { return chain.subscriptions() == 1 })
+	chain.extend(11)
+	waitFor(t, "block 11", func() bool { return len(printed(out)) == 1 })
+
+	// Blocks 12 and 13 are mined while the subscription is down and are
+	// backfilled when head 14 arrives on the new one.
+	restart()
+	chain.extend(13)
+	waitFor(t, "the resubscription", func() bool { return chain.subscriptions() == 2 })
+	chain.extend(14)
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := printed(out), []uint64{11, 12, 13, 14}; !reflect.DeepEqual(got, want) {
+		t.Errorf("printed blocks %v, want %v", got, want)
+	}
+}
+
+func TestBlockMonitorFirstConnectionFails(t *testing.T) {
+	m := &blockMonitor{endpoint: "ws://127.0.0.1:1", totalCount: 1, pollInterval: time.Hour, out: &testSink{}}
+	if err := m.run(context.Background()); err == nil {
+		t.Error("run returned no error for an unreachable endpoint")
+	}
+}
+
+func TestBlockMonitorPolls(t *testing.T) {
+	for _, ws := range []bool{false, true} {
+		chain := newTestForkChain(10)
+		endpoint, _ := newTestEndpoint(t, &testPolledChain{chain}, ws)
+		out := &testSink{}
+		m := &blockMonitor{endpoint: endpoint, totalCount: 4, pollInterval: 10 * time.Millisecond, out: out}
+		result := make(chan error, 1)
+		go func() { result <- m.run(context.Background()) }()
+
+		waitFor(t, "block 10", func() bool { return len(printed(out)) == 1 })
+		// The head skips blocks 11 and 12, which are backfilled.
+		chain.extend(13)
+		if err := <-result; err != nil {
+			t.Fatalf("%s: %v", endpoint, err)
+		}
+		if got, want := printed(out), []uint64{10, 11, 12, 13}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: printed blocks %v, want %v", endpoint, got, want)
+		}
+	}
+}
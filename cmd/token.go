@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	log "github.com/sirupsen/logrus"
+	"github.com/xueqianLu/ethtools/erc20"
+)
+
+// tokenInfo is the metadata needed to show amounts of an ERC-20 token.
+type tokenInfo struct {
+	address  common.Address
+	symbol   string
+	decimals uint8
+}
+
+// loadTokenInfo reads the symbol and decimals of a token. Both are optional
+// in ERC-20, so a token without them is shown with its address as symbol
+// and amounts in base units.
+func loadTokenInfo(ctx context.Context, contract *erc20.Erc20, address common.Address) tokenInfo {
+	info := tokenInfo{address: address, symbol: address.Hex()}
+	opts := &bind.CallOpts{Context: ctx}
+	if symbol, err := contract.Symbol(opts); err != nil {
+		log.Warnf("Token %s has no symbol(): %v", address.Hex(), err)
+	} else if symbol != "" {
+		info.symbol = symbol
+	}
+	if decimals, err := contract.Decimals(opts); err != nil {
+		log.Warnf("Token %s has no decimals(), showing base units: %v", address.Hex(), err)
+	} else {
+		info.decimals = decimals
+	}
+	return info
+}
+
+// format renders an amount in base units as token units with the symbol.
+func (t tokenInfo) format(v *big.Int) string {
+	return formatTokenAmount(v, t.decimals) + " " + t.symbol
+}
+
+// formatTokenAmount renders an amount in base units as a decimal number of
+// token units, without trailing fractional zeros.
+func formatTokenAmount(v *big.Int, decimals uint8) string {
+	neg := v.Sign() < 0
+	digits := new(big.Int).Abs(v).String()
+	if decimals > 0 {
+		if len(digits) <= int(decimals) {
+			digits = strings.Repeat("0", int(decimals)-len(digits)+1) + digits
+		}
+		point := len(digits) - int(decimals)
+		if frac := strings.TrimRight(digits[point:], "0"); frac != "" {
+			digits = digits[:point] + "." + frac
+		} else {
+			digits = digits[:point]
+		}
+	}
+	if neg {
+		return "-" + digits
+	}
+	return digits
+}
+
+// parseTokenAmount converts a decimal number of token units, e.g. 1.5, to
+// base units.
+func parseTokenAmount(s string, decimals uint8) (*big.Int, error) {
+	if s == "" || s == "." {
+		return nil, fmt.Errorf("invalid amount %q", s)
+	}
+	whole, frac, _ := strings.Cut(s, ".")
+	if len(frac) > int(decimals) {
+		return nil, fmt.Errorf("%q has more than %d decimals", s, decimals)
+	}
+	digits := whole + frac + strings.Repeat("0", int(decimals)-len(frac))
+	v, ok := new(big.Int).SetString(digits, 10)
+	if !ok || v.Sign() < 0 || strings.HasPrefix(digits, "+") {
+		return nil, fmt.Errorf("invalid amount %q", s)
+	}
+	return v, nil
+}
+
+// tokenUnits returns an amount in base units as a float number of token
+// units, for metrics.
+func tokenUnits(v *big.Int, decimals uint8) float64 {
+	f := new(big.Float).SetInt(v)
+	f.Quo(f, new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(decimals)), nil)))
+	res, _ := f.Float64()
+	return res
+}
+
+// listedToken is one entry of a token list file. Symbol and decimals are
+// optional in CSV lists.
+type listedToken struct {
+	address  common.Address
+	symbol   string
+	decimals *uint8
+}
+
+// loadTokenList reads a token list file: a Uniswap token list (JSON) or a
+// CSV file with address[,symbol[,decimals]] lines. Tokens a Uniswap list
+// assigns to another chain than chainID are left out.
+func loadTokenList(path string, chainID *big.Int) ([]listedToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		var list struct {
+			Tokens []struct {
+				ChainID  int64  `json:"chainId"`
+				Address  string `json:"address"`
+				Symbol   string `json:"symbol"`
+				Decimals uint8  `json:"decimals"`
+			} `json:"tokens"`
+		}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		var res []listedToken
+		for _, t := range list.Tokens {
+			if chainID != nil && t.ChainID != 0 && t.ChainID != chainID.Int64() {
+				continue
+			}
+			if !common.IsHexAddress(t.Address) {
+				return nil, fmt.Errorf("%s: not an address: %s", path, t.Address)
+			}
+			decimals := t.Decimals
+			res = append(res, listedToken{address: common.HexToAddress(t.Address), symbol: t.Symbol, decimals: &decimals})
+		}
+		return res, nil
+	}
+
+	r := csv.NewReader(strings.NewReader(string(data)))
+	r.Comment = '#'
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	var res []listedToken
+	for i, rec := range records {
+		addr := strings.TrimSpace(rec[0])
+		if !common.IsHexAddress(addr) {
+			if i == 0 {
+				continue // header
+			}
+			return nil, fmt.Errorf("%s: not an address: %s", path, addr)
+		}
+		t := listedToken{address: common.HexToAddress(addr)}
+		if len(rec) > 1 {
+			t.symbol = strings.TrimSpace(rec[1])
+		}
+		if len(rec) > 2 && strings.TrimSpace(rec[2]) != "" {
+			d, err := strconv.ParseUint(strings.TrimSpace(rec[2]), 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%s: decimals of %s: %w", path, addr, err)
+			}
+			decimals := uint8(d)
+			t.decimals = &decimals
+		}
+		res = append(res, t)
+	}
+	return res, nil
+}
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestFormatTokenAmount(t *testing.T) {
+	tests := []struct {
+		v        string
+		decimals uint8
+		want     string
+	}{
+		{v: "0", decimals: 18, want: "0"},
+		{v: "0", decimals: 0, want: "0"},
+		{v: "1234", decimals: 0, want: "1234"},
+		{v: "1000000", decimals: 6, want: "1"},
+		{v: "1500000", decimals: 6, want: "1.5"},
+		{v: "1", decimals: 18, want: "0.000000000000000001"},
+		{v: "123456789", decimals: 4, want: "12345.6789"},
+		{v: "-2500", decimals: 3, want: "-2.5"},
+		{v: "115792089237316195423570985008687907853269984665640564039457584007913129639935", decimals: 18,
+			want: "115792089237316195423570985008687907853269984665640564039457.584007913129639935"},
+	}
+	for _, tt := range tests {
+		v, _ := new(big.Int).SetString(tt.v, 10)
+		if got := formatTokenAmount(v, tt.decimals); got != tt.want {
+			t.Errorf("formatTokenAmount(%s, %d) = %s, want %s", tt.v, tt.decimals, got, tt.want)
+		}
+	}
+}
+
+func TestParseTokenAmount(t *testing.T) {
+	tests := []struct {
+		s        string
+		decimals uint8
+		want     string // base units, empty for an error
+	}{
+		{s: "1", decimals: 6, want: "1000000"},
+		{s: "1.5", decimals: 6, want: "1500000"},
+		{s: ".5", decimals: 2, want: "50"},
+		{s: "1.", decimals: 2, want: "100"},
+		{s: "0.000001", decimals: 6, want: "1"},
+		{s: "42", decimals: 0, want: "42"},
+		{s: "1000000000", decimals: 18, want: "1000000000000000000000000000"},
+		{s: "0.0000001", decimals: 6},
+		{s: "1.5", decimals: 0},
+		{s: "", decimals: 6},
+		{s: ".", decimals: 6},
+		{s: "-1", decimals: 6},
+		{s: "+1", decimals: 6},
+		{s: "1e6", decimals: 6},
+		{s: "0x10", decimals: 0},
+		{s: "1.2.3", decimals: 6},
+	}
+	for _, tt := range tests {
+		got, err := parseTokenAmount(tt.s, tt.decimals)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("parseTokenAmount(%q, %d) = %s, want an error", tt.s, tt.decimals, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTokenAmount(%q, %d): %v", tt.s, tt.decimals, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("parseTokenAmount(%q, %d) = %s, want %s", tt.s, tt.decimals, got, tt.want)
+		}
+		// Formatting gives back the same amount.
+		back, _ := parseTokenAmount(formatTokenAmount(got, tt.decimals), tt.decimals)
+		if back == nil || back.Cmp(got) != 0 {
+			t.Errorf("parseTokenAmount(formatTokenAmount(%s)) = %v", got, back)
+		}
+	}
+}
+
+func TestLoadTokenList(t *testing.T) {
+	usdc := common.HexToAddress("0xa0b86991c6218b36c1d19d4a2e9eb0ce3606eb48")
+	usdt := common.HexToAddress("0xdac17f958d2ee523a2206206994597c13d831ec7")
+	u8 := func(v uint8) *uint8 { return &v }
+	tests := []struct {
+		name    string
+		data    string
+		chainID *big.Int
+		want    []listedToken
+		wantErr bool
+	}{
+		{
+			name: "uniswap list",
+			data: `{"name": "test", "tokens": [
+				{"chainId": 1, "address": "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48", "symbol": "USDC", "decimals": 6},
+				{"chainId": 10, "address": "0x0b2C639c533813f4Aa9D7837CAf62653d097Ff85", "symbol": "USDC", "decimals": 6},
+				{"chainId": 1, "address": "0xdAC17F958D2ee523a2206206994597C13D831ec7", "symbol": "USDT", "decimals": 6}
+			]}`,
+			chainID: big.NewInt(1),
+			want:    []listedToken{{address: usdc, symbol: "USDC", decimals: u8(6)}, {address: usdt, symbol: "USDT", decimals: u8(6)}},
+		},
+		{
+			name:    "uniswap list with a bad address",
+			data:    `{"tokens": [{"chainId": 1, "address": "0x1234", "symbol": "BAD"}]}`,
+			chainID: big.NewInt(1),
+			wantErr: true,
+		},
+		{name: "malformed json", data: `{"tokens": [`, wantErr: true},
+		{
+			name: "csv with header and comments",
+			data: "address,symbol,decimals\n" +
+				"# stablecoins\n" +
+				"0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48, USDC, 6\n" +
+				"0xdAC17F958D2ee523a2206206994597C13D831ec7\n",
+			want: []listedToken{{address: usdc, symbol: "USDC", decimals: u8(6)}, {address: usdt}},
+		},
+		{
+			name: "csv without decimals",
+			data: "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48,USDC,\n",
+			want: []listedToken{{address: usdc, symbol: "USDC"}},
+		},
+		{name: "csv with a bad address", data: "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48\nnot-an-address\n", wantErr: true},
+		{name: "csv with bad decimals", data: "0xA0b86991c6218b36c1d19D4a2e9Eb0cE3606eB48,USDC,256\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "tokens")
+		if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadTokenList(path, tt.chainID)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: loadTokenList() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
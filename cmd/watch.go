@@ -0,0 +1,366 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const (
+	AbiFlag   = "abi"
+	EventFlag = "event"
+	ArgFlag   = "arg"
+)
+
+// watchCmd represents the generic event watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Watch and decode contract events described by ABI files",
+	Run: func(cmd *cobra.Command, args []string) {
+		chainEndpoint, _ := cmd.Flags().GetString(ChainEndpointFlag)
+		abiFiles, _ := cmd.Flags().GetStringSlice(AbiFlag)
+		eventNames, _ := cmd.Flags().GetStringSlice(EventFlag)
+		addrStrs, _ := cmd.Flags().GetStringSlice(AddressFlag)
+		addrFile, _ := cmd.Flags().GetString(AddressFileFlag)
+		argFilters, _ := cmd.Flags().GetStringArray(ArgFlag)
+		if chainEndpoint == "" {
+			log.Error("Chain endpoint is required")
+			return
+		}
+		if len(abiFiles) == 0 {
+			log.Error("At least one --abi file is required")
+			return
+		}
+
+		addresses, err := loadAddresses(addrStrs, addrFile)
+		if err != nil {
+			log.WithError(err).Error("Invalid --address/--address-file")
+			return
+		}
+		events, err := loadEvents(abiFiles, eventNames)
+		if err != nil {
+			log.WithError(err).Error("Invalid --abi/--event")
+			return
+		}
+		filters, err := eventFilters(events, argFilters)
+		if err != nil {
+			log.WithError(err).Error("Invalid --arg")
+			return
+		}
+
+		if err := doWatch(cmd.Context(), chainEndpoint, addresses, filters); err != nil && !stopped(cmd) {
+			log.WithError(err).Error("watch failed")
+			return
+		}
+	},
+}
+
+func init() {
+	watchCmd.Flags().String(ChainEndpointFlag, "", "Chain endpoint URL (must support subscriptions)")
+	watchCmd.Flags().StringSlice(AbiFlag, nil, "ABI file: a JSON ABI array or a build artifact with an \"abi\" field (repeatable)")
+	watchCmd.Flags().StringSlice(EventFlag, nil, "Event to watch, by name or signature, e.g. Transfer or Transfer(address,address,uint256) (repeatable). Default: every event in the ABI files")
+	watchCmd.Flags().StringSlice(AddressFlag, nil, "Contract address to watch (optional, repeatable). Default: any contract")
+	watchCmd.Flags().String(AddressFileFlag, "", "File with contract addresses to watch: a JSON array or one address per line")
+	watchCmd.Flags().StringArray(ArgFlag, nil, "Indexed argument filter name=value[,value...] (repeatable). Events without that indexed argument are not watched")
+	_ = watchCmd.MarkFlagRequired(AbiFlag)
+
+	rootCmd.AddCommand(watchCmd)
+}
+
+// loadEvents reads the ABI files and returns the named events, or all
+// non-anonymous events if names is empty.
+func loadEvents(files []string, names []string) ([]abi.Event, error) {
+	var all []abi.Event
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		// Build artifacts of Hardhat, Truffle and Foundry keep the ABI
+		// under "abi".
+		var artifact struct {
+			ABI json.RawMessage `json:"abi"`
+		}
+		if json.Unmarshal(data, &artifact) == nil && len(artifact.ABI) > 0 {
+			data = artifact.ABI
+		}
+		parsed, err := abi.JSON(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for _, ev := range parsed.Events {
+			all = append(all, ev)
+		}
+	}
+
+	seen := make(map[common.Hash]bool)
+	var res []abi.Event
+	add := func(ev abi.Event) {
+		if !seen[ev.ID] {
+			seen[ev.ID] = true
+			res = append(res, ev)
+		}
+	}
+	if len(names) == 0 {
+		for _, ev := range all {
+			if !ev.Anonymous {
+				add(ev)
+			}
+		}
+		if len(res) == 0 {
+			return nil, fmt.Errorf("the ABI files contain no events")
+		}
+		return res, nil
+	}
+	for _, name := range names {
+		found := false
+		for _, ev := range all {
+			if ev.Name != name && ev.RawName != name && ev.Sig != name {
+				continue
+			}
+			if ev.Anonymous {
+				return nil, fmt.Errorf("event %s is anonymous and cannot be watched by topic", ev.Sig)
+			}
+			found = true
+			add(ev)
+		}
+		if !found {
+			return nil, fmt.Errorf("event %q not found in the ABI files", name)
+		}
+	}
+	return res, nil
+}
+
+// eventFilter is one event to watch with the topic filter of its indexed
+// arguments.
+type eventFilter struct {
+	event  abi.Event
+	topics [][]common.Hash
+}
+
+// eventFilters turns the --arg filters into topic filters for every event.
+// Events that lack one of the filtered arguments are dropped, since none of
+// their logs could match.
+func eventFilters(events []abi.Event, args []string) ([]eventFilter, error) {
+	values := make(map[string][]string)
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("%q: want name=value", arg)
+		}
+		values[name] = append(values[name], strings.Split(value, ",")...)
+	}
+
+	var res []eventFilter
+	for _, ev := range events {
+		topics := [][]common.Hash{{ev.ID}}
+		matched := 0
+		pos := 0
+		for _, input := range ev.Inputs {
+			if !input.Indexed {
+				if _, ok := values[input.Name]; ok {
+					return nil, fmt.Errorf("argument %s of %s is not indexed", input.Name, ev.Sig)
+				}
+				continue
+			}
+			pos++
+			vals, ok := values[input.Name]
+			if !ok {
+				continue
+			}
+			for len(topics) <= pos {
+				topics = append(topics, nil)
+			}
+			for _, v := range vals {
+				t, err := topicFor(input.Type, v)
+				if err != nil {
+					return nil, fmt.Errorf("%s of %s: %w", input.Name, ev.Sig, err)
+				}
+				topics[pos] = append(topics[pos], t)
+			}
+			matched++
+		}
+		if matched < len(values) {
+			log.Debugf("Not watching %s: it lacks some of the filtered arguments", ev.Sig)
+			continue
+		}
+		res = append(res, eventFilter{event: ev, topics: topics})
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no selected event has all of the filtered indexed arguments")
+	}
+	return res, nil
+}
+
+// topicFor encodes the value of an indexed argument as its log topic.
+func topicFor(t abi.Type, s string) (common.Hash, error) {
+	switch t.T {
+	case abi.AddressTy:
+		if !common.IsHexAddress(s) {
+			return common.Hash{}, fmt.Errorf("invalid address %q", s)
+		}
+		return common.BytesToHash(common.HexToAddress(s).Bytes()), nil
+	case abi.IntTy, abi.UintTy:
+		v, ok := new(big.Int).SetString(s, 0)
+		if !ok {
+			return common.Hash{}, fmt.Errorf("invalid integer %q", s)
+		}
+		return common.BytesToHash(math.U256Bytes(v)), nil
+	case abi.BoolTy:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		var h common.Hash
+		if b {
+			h[common.HashLength-1] = 1
+		}
+		return h, nil
+	case abi.FixedBytesTy:
+		b, err := hexutil.Decode(s)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if len(b) > t.Size {
+			return common.Hash{}, fmt.Errorf("%q is longer than %d bytes", s, t.Size)
+		}
+		var h common.Hash
+		copy(h[:], b)
+		return h, nil
+	case abi.StringTy:
+		return crypto.Keccak256Hash([]byte(s)), nil
+	case abi.BytesTy:
+		b, err := hexutil.Decode(s)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		return crypto.Keccak256Hash(b), nil
+	}
+	return common.Hash{}, fmt.Errorf("filtering on %s arguments is not supported", t)
+}
+
+// doWatch subscribes to the logs of every event filter and prints each log
+// decoded with its event. It returns when a subscription fails or ctx is
+// done, after logging how many events of each kind it printed.
+func doWatch(ctx context.Context, endpoint string, addresses []common.Address, filters []eventFilter) error {
+	client, err := ethclient.DialContext(ctx, endpoint)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the Ethereum client: %w", err)
+	}
+	defer client.Close()
+
+	byID := make(map[common.Hash]abi.Event, len(filters))
+	logs := make(chan types.Log)
+	errs := make(chan error, len(filters))
+	for _, f := range filters {
+		byID[f.event.ID] = f.event
+		query := ethereum.FilterQuery{Addresses: addresses, Topics: f.topics}
+		sub, err := client.SubscribeFilterLogs(ctx, query, logs)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to %s: %w", f.event.Sig, err)
+		}
+		defer sub.Unsubscribe()
+		go func(sub ethereum.Subscription, sig string) {
+			if err := <-sub.Err(); err != nil {
+				errs <- fmt.Errorf("%s subscription: %w", sig, err)
+			}
+		}(sub, f.event.Sig)
+		log.Infof("Watching %s", f.event.Sig)
+	}
+
+	counts := make(map[string]int, len(filters))
+	defer func() {
+		parts := make([]string, 0, len(filters))
+		for _, f := range filters {
+			parts = append(parts, fmt.Sprintf("%s=%d", f.event.Sig, counts[f.event.Sig]))
+		}
+		log.Infof("watch summary: %s", strings.Join(parts, " "))
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			return err
+		case l := <-logs:
+			if len(l.Topics) == 0 {
+				continue
+			}
+			ev, ok := byID[l.Topics[0]]
+			if !ok {
+				continue
+			}
+			printEvent(ev, l)
+			counts[ev.Sig]++
+		}
+	}
+}
+
+// printEvent prints l decoded as ev, one named field per line in the order
+// of the event's inputs.
+func printEvent(ev abi.Event, l types.Log) {
+	fields := make(map[string]interface{})
+	if err := ev.Inputs.UnpackIntoMap(fields, l.Data); err != nil {
+		log.Errorf("Failed to decode %s data in tx %s: %v", ev.Name, l.TxHash.Hex(), err)
+		return
+	}
+	var indexed abi.Arguments
+	for _, input := range ev.Inputs {
+		if input.Indexed {
+			indexed = append(indexed, input)
+		}
+	}
+	if err := abi.ParseTopicsIntoMap(fields, indexed, l.Topics[1:]); err != nil {
+		log.Errorf("Failed to decode %s topics in tx %s: %v", ev.Name, l.TxHash.Hex(), err)
+		return
+	}
+
+	fmt.Println("Event:", ev.Sig)
+	fmt.Println("Block Number:", l.BlockNumber)
+	fmt.Println("Transaction Hash:", l.TxHash.Hex())
+	fmt.Println("Contract Address:", l.Address.Hex())
+	if l.Removed {
+		fmt.Println("Removed: true")
+	}
+	for _, input := range ev.Inputs {
+		fmt.Printf("%s: %s\n", input.Name, formatEventValue(fields[input.Name]))
+	}
+}
+
+func formatEventValue(v interface{}) string {
+	switch v := v.(type) {
+	case common.Address:
+		return v.Hex()
+	case common.Hash:
+		return v.Hex()
+	case []byte:
+		return hexutil.Encode(v)
+	case *big.Int:
+		return v.String()
+	}
+	// Fixed-size byte arrays, bytesN.
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Array && rv.Type().Elem().Kind() == reflect.Uint8 {
+		b := make([]byte, rv.Len())
+		reflect.Copy(reflect.ValueOf(b), rv)
+		return hexutil.Encode(b)
+	}
+	return fmt.Sprintf("%v", v)
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestTopicFor(t *testing.T) {
+	typ := func(name string) abi.Type {
+		ty, err := abi.NewType(name, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ty
+	}
+	addr := "0xdAC17F958D2ee523a2206206994597C13D831ec7"
+	tests := []struct {
+		typ     string
+		value   string
+		want    common.Hash
+		wantErr bool
+	}{
+		{typ: "address", value: addr, want: common.HexToHash(addr)},
+		{typ: "address", value: "0x1234", wantErr: true},
+		{typ: "uint256", value: "1000", want: common.HexToHash("0x3e8")},
+		{typ: "uint256", value: "0x10", want: common.HexToHash("0x10")},
+		{typ: "uint256", value: "ten", wantErr: true},
+		{typ: "int256", value: "-1", want: common.HexToHash("0xffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff")},
+		{typ: "bool", value: "true", want: common.HexToHash("0x01")},
+		{typ: "bool", value: "false", want: common.Hash{}},
+		{typ: "bool", value: "yes", wantErr: true},
+		{typ: "bytes4", value: "0xa9059cbb", want: common.HexToHash("0xa9059cbb00000000000000000000000000000000000000000000000000000000")},
+		{typ: "bytes4", value: "0xa9059cbb00", wantErr: true},
+		{typ: "string", value: "hello", want: crypto.Keccak256Hash([]byte("hello"))},
+		{typ: "bytes", value: "0x0102", want: crypto.Keccak256Hash([]byte{1, 2})},
+		{typ: "bytes", value: "0102", wantErr: true},
+		{typ: "uint256[]", value: "1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := topicFor(typ(tt.typ), tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("topicFor(%s, %q) error = %v, wantErr %v", tt.typ, tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("topicFor(%s, %q) = %s, want %s", tt.typ, tt.value, got.Hex(), tt.want.Hex())
+		}
+	}
+}
+
+const testERC20ABI = `[
+	{"type": "event", "name": "Transfer", "inputs": [
+		{"name": "from", "type": "address", "indexed": true},
+		{"name": "to", "type": "address", "indexed": true},
+		{"name": "value", "type": "uint256", "indexed": false}]},
+	{"type": "event", "name": "Approval", "inputs": [
+		{"name": "owner", "type": "address", "indexed": true},
+		{"name": "spender", "type": "address", "indexed": true},
+		{"name": "value", "type": "uint256", "indexed": false}]}
+]`
+
+func TestEventFilters(t *testing.T) {
+	parsed, err := abi.JSON(strings.NewReader(testERC20ABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	transfer, approval := parsed.Events["Transfer"], parsed.Events["Approval"]
+	events := []abi.Event{transfer, approval}
+	a := common.HexToAddress("0x0a")
+	b := common.HexToAddress("0x0b")
+	ta, tb := common.BytesToHash(a.Bytes()), common.BytesToHash(b.Bytes())
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    map[string][][]common.Hash // event name to topics
+		wantErr bool
+	}{
+		{name: "no filter", want: map[string][][]common.Hash{
+			"Transfer": {{transfer.ID}},
+			"Approval": {{approval.ID}},
+		}},
+		{name: "first argument", args: []string{"from=" + a.Hex()}, want: map[string][][]common.Hash{
+			"Transfer": {{transfer.ID}, {ta}},
+		}},
+		{name: "second argument, several values", args: []string{"to=" + a.Hex() + "," + b.Hex()}, want: map[string][][]common.Hash{
+			"Transfer": {{transfer.ID}, nil, {ta, tb}},
+		}},
+		{name: "repeated argument", args: []string{"spender=" + a.Hex(), "spender=" + b.Hex(), "owner=" + b.Hex()}, want: map[string][][]common.Hash{
+			"Approval": {{approval.ID}, {tb}, {ta, tb}},
+		}},
+		{name: "not indexed", args: []string{"value=1"}, wantErr: true},
+		{name: "no event has all arguments", args: []string{"from=" + a.Hex(), "owner=" + a.Hex()}, wantErr: true},
+		{name: "unknown argument", args: []string{"sender=" + a.Hex()}, wantErr: true},
+		{name: "malformed", args: []string{"from"}, wantErr: true},
+		{name: "empty value", args: []string{"from="}, wantErr: true},
+		{name: "bad value", args: []string{"from=0x1234"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		filters, err := eventFilters(events, tt.args)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got := make(map[string][][]common.Hash)
+		for _, f := range filters {
+			got[f.event.Name] = f.topics
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: eventFilters() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}